@@ -0,0 +1,255 @@
+package cogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/tiff"
+)
+
+// reorderBands rearranges the bands of ifd so that band i of the output is band
+// order[i] of the input. Tiles of planar (PlanarConfiguration=2) ifds are simply
+// reordered, whereas chunky tiles are decoded, permuted and compressed again.
+func (ifd *ifd) reorderBands(order []int) error {
+	spp := int(ifd.SamplesPerPixel)
+	if len(order) != spp {
+		return fmt.Errorf("band order %v does not match %d bands", order, spp)
+	}
+	seen := make([]bool, spp)
+	for i, b := range order {
+		if b < 0 || b >= spp || seen[b] {
+			return fmt.Errorf("band order %v is not a permutation of the %d bands", order, spp)
+		}
+		seen[b] = true
+		if i >= spp-len(ifd.ExtraSamples) && b != i {
+			return fmt.Errorf("band order %v moves extra sample %d", order, i)
+		}
+	}
+	if len(ifd.BitsPerSample) != spp {
+		return fmt.Errorf("expecting %d BitsPerSample values, got %d", spp, len(ifd.BitsPerSample))
+	}
+	for _, bps := range ifd.BitsPerSample {
+		if bps != ifd.BitsPerSample[0] || bps%8 != 0 {
+			return fmt.Errorf("unsupported BitsPerSample %v", ifd.BitsPerSample)
+		}
+	}
+	if len(ifd.SampleFormat) == spp {
+		sf := make([]uint16, spp)
+		for i, b := range order {
+			sf[i] = ifd.SampleFormat[b]
+		}
+		ifd.SampleFormat = sf
+	}
+	if ifd.GDALMetaData != "" {
+		//band items (e.g. statistics or descriptions) follow their band
+		samples := make(map[int]int, spp)
+		for i, b := range order {
+			samples[b] = i
+		}
+		md, err := remapMetadataSamples(ifd.GDALMetaData, samples)
+		if err != nil {
+			return err
+		}
+		ifd.GDALMetaData = md
+	}
+
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
+		//tiles are stored plane after plane
+		ntiles := len(ifd.TileByteCounts) / spp
+		offsets := make([]uint64, len(ifd.OriginalTileOffsets))
+		counts := make([]uint32, len(ifd.TileByteCounts))
+		for i, b := range order {
+			copy(offsets[i*ntiles:(i+1)*ntiles], ifd.OriginalTileOffsets[b*ntiles:(b+1)*ntiles])
+			copy(counts[i*ntiles:(i+1)*ntiles], ifd.TileByteCounts[b*ntiles:(b+1)*ntiles])
+		}
+		ifd.OriginalTileOffsets, ifd.TileByteCounts = offsets, counts
+		return nil
+	}
+
+	if ifd.Predictor == predictorFloatingPoint {
+		//the floating point predictor shuffles bytes across samples. Horizontal
+		//differencing is done sample by sample and is not affected by a permutation
+		return fmt.Errorf("unsupported floating point predictor")
+	}
+	ssize := int(ifd.BitsPerSample[0]) / 8
+	psize := ssize * spp
+	size := int(ifd.TileWidth) * int(ifd.TileLength) * psize
+	return ifd.transcodeTiles(func(idx int, tile []byte) ([]byte, error) {
+		pix, err := decompress(ifd.Compression, tile, size)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, size)
+		for p := 0; p < size; p += psize {
+			for i, b := range order {
+				copy(out[p+i*ssize:p+(i+1)*ssize], pix[p+b*ssize:p+(b+1)*ssize])
+			}
+		}
+		return compress(ifd.Compression, out)
+	})
+}
+
+// separatePlanes converts the chunky tiles of ifd to PlanarConfiguration=2 ones,
+// i.e. one tile per band for each tile position. Tiles must be decoded and
+// compressed again, and are kept in memory
+func (ifd *ifd) separatePlanes() error {
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
+		return nil
+	}
+	spp := int(ifd.SamplesPerPixel)
+	if len(ifd.BitsPerSample) != spp {
+		return fmt.Errorf("expecting %d BitsPerSample values, got %d", spp, len(ifd.BitsPerSample))
+	}
+	for _, bps := range ifd.BitsPerSample {
+		if bps != ifd.BitsPerSample[0] || bps%8 != 0 {
+			return fmt.Errorf("unsupported BitsPerSample %v", ifd.BitsPerSample)
+		}
+	}
+	switch ifd.Compression {
+	case compressionNone, compressionLZW, compressionDeflate, compressionAdobeDeflate:
+	default:
+		return fmt.Errorf("unsupported compression %d", ifd.Compression)
+	}
+	if ifd.Predictor == predictorFloatingPoint {
+		//the floating point predictor shuffles bytes across samples. Horizontal
+		//differencing is done sample by sample and survives the split
+		return fmt.Errorf("unsupported floating point predictor")
+	}
+	if spp == 1 {
+		ifd.PlanarConfiguration = planarConfigurationSeparate
+		return nil
+	}
+	ssize := int(ifd.BitsPerSample[0]) / 8
+	psize := ssize * spp
+	npix := int(ifd.TileWidth) * int(ifd.TileLength)
+	ntiles := len(ifd.TileByteCounts)
+	data := []byte{}
+	offsets := make([]uint64, ntiles*spp)
+	counts := make([]uint32, ntiles*spp)
+	planes := make([][]byte, spp)
+	for b := range planes {
+		planes[b] = make([]byte, npix*ssize)
+	}
+	for i := 0; i < ntiles; i++ {
+		bc := int(ifd.TileByteCounts[i])
+		if bc == 0 {
+			continue
+		}
+		tile := make([]byte, bc)
+		if n, err := ifd.r.ReadAt(tile, int64(ifd.OriginalTileOffsets[i])); n < bc {
+			return fmt.Errorf("read tile %d: %w", i, err)
+		}
+		pix, err := decompress(ifd.Compression, tile, npix*psize)
+		if err != nil {
+			return fmt.Errorf("tile %d: %w", i, err)
+		}
+		for p := 0; p < npix; p++ {
+			for b := range planes {
+				copy(planes[b][p*ssize:(p+1)*ssize], pix[p*psize+b*ssize:p*psize+(b+1)*ssize])
+			}
+		}
+		for b := range planes {
+			enc, err := compress(ifd.Compression, planes[b])
+			if err != nil {
+				return fmt.Errorf("tile %d: %w", i, err)
+			}
+			offsets[b*ntiles+i] = uint64(len(data))
+			counts[b*ntiles+i] = uint32(len(enc))
+			data = append(data, enc...)
+		}
+	}
+	ifd.OriginalTileOffsets = offsets
+	ifd.TileByteCounts = counts
+	ifd.PlanarConfiguration = planarConfigurationSeparate
+	ifd.r = tiff.NewBReader(bytes.NewReader(data), ifd.r.ByteOrder())
+	ifd.inMemory = true
+	return nil
+}
+
+// setPhotometric replaces the PhotometricInterpretation of ifd, after checking
+// that its number of color (i.e. non extra) samples suits the new value
+func (ifd *ifd) setPhotometric(photometric uint16) error {
+	colors := int(ifd.SamplesPerPixel) - len(ifd.ExtraSamples)
+	expected := 0
+	switch photometric {
+	case photometricInterpretationRGB, photometricInterpretationYCbCr, photometricInterpretationCIELab,
+		photometricInterpretationICCLab, photometricInterpretationITULab:
+		expected = 3
+	case photometricInterpretationSeparated:
+		expected = 4
+	case photometricInterpretationPalette:
+		if len(ifd.Colormap) == 0 {
+			return fmt.Errorf("palette photometric interpretation without a colormap")
+		}
+		expected = 1
+	case photometricInterpretationMask:
+		return fmt.Errorf("cannot set the mask photometric interpretation on an image")
+	}
+	if expected > 0 && colors != expected {
+		return fmt.Errorf("photometric interpretation %d requires %d color samples, got %d", photometric, expected, colors)
+	}
+	ifd.PhotometricInterpretation = photometric
+	return nil
+}
+
+// setByteOrder converts the tiles of ifd so that they can be written to a file
+// with the given byte order. This only matters for samples wider than 8 bits
+// compressed with general purpose codecs, whose decoded bytes follow the byte
+// order of the file: they are decoded, byte swapped and compressed again.
+// Horizontal differencing is left untouched, as the differences are stored as
+// samples. Image codecs (e.g. JPEG or LERC) define their own encoding and are
+// copied as is.
+func (ifd *ifd) setByteOrder(order binary.ByteOrder) error {
+	if ifd.r.ByteOrder() == order {
+		return nil
+	}
+	switch ifd.Compression {
+	case compressionJPEG, compressionLERC, compressionWEBP, compressionJXL:
+		return nil
+	}
+	bits := uint16(0)
+	for _, bps := range ifd.BitsPerSample {
+		if bps > bits {
+			bits = bps
+		}
+	}
+	if bits <= 8 {
+		return nil
+	}
+	for _, bps := range ifd.BitsPerSample {
+		if bps != bits || bps%8 != 0 {
+			return fmt.Errorf("cannot change the byte order of BitsPerSample %v", ifd.BitsPerSample)
+		}
+	}
+	switch ifd.Compression {
+	case compressionNone, compressionLZW, compressionDeflate, compressionAdobeDeflate:
+	default:
+		return fmt.Errorf("cannot change the byte order of %d bit %s tiles", bits, Compression(ifd.Compression))
+	}
+	if ifd.Predictor == predictorFloatingPoint {
+		return fmt.Errorf("cannot change the byte order of tiles with the floating point predictor")
+	}
+	width := int(bits / 8)
+	size := int(ifd.TileWidth) * int(ifd.TileLength) * ifd.pixelSize()
+	err := ifd.transcodeTiles(func(idx int, tile []byte) ([]byte, error) {
+		pix, err := decompress(ifd.Compression, tile, size)
+		if err != nil {
+			return nil, err
+		}
+		if ifd.Compression == compressionNone {
+			pix = append([]byte{}, pix...) //do not modify the tile read by transcodeTiles
+		}
+		for s := 0; s+width <= len(pix); s += width {
+			for i, j := s, s+width-1; i < j; i, j = i+1, j-1 {
+				pix[i], pix[j] = pix[j], pix[i]
+			}
+		}
+		return compress(ifd.Compression, pix)
+	})
+	if err != nil {
+		return err
+	}
+	ifd.r = tiff.NewBReader(ifd.r, order)
+	return nil
+}
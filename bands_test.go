@@ -0,0 +1,197 @@
+package cogger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBandOrder(t *testing.T) {
+	src, err := os.ReadFile("testdata/rgb.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.BandOrder = []int{2, 1, 0}
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	in, out := parseIFDs(t, src), parseIFDs(t, buf.Bytes())
+	sortIFDs(in)
+	for i := range in {
+		intiles, outtiles := decodedTiles(t, in[i]), decodedTiles(t, out[i])
+		for j := range intiles {
+			for p := 0; p < len(intiles[j]); p += 3 {
+				if outtiles[j][p] != intiles[j][p+2] || outtiles[j][p+1] != intiles[j][p+1] || outtiles[j][p+2] != intiles[j][p] {
+					t.Fatalf("ifd %d tile %d: pixel %d not swapped", i, j, p/3)
+				}
+			}
+		}
+	}
+
+	src, err = os.ReadFile("testdata/band4.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.BandOrder = []int{2, 1, 0, 3}
+	buf.Reset()
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	in, out = parseIFDs(t, src), parseIFDs(t, buf.Bytes())
+	intiles, outtiles := decodedTiles(t, in[0]), decodedTiles(t, out[0])
+	ntiles := len(intiles) / 4
+	for i, b := range cfg.BandOrder {
+		for j := 0; j < ntiles; j++ {
+			if !bytes.Equal(outtiles[i*ntiles+j], intiles[b*ntiles+j]) {
+				t.Errorf("band %d tile %d: expected content of band %d", i, j, b)
+			}
+		}
+	}
+
+	cfg.BandOrder = []int{3, 1, 2, 0}
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+		t.Error("alpha band moved")
+	}
+
+	//band metadata items follow their band, items of unknown bands are dropped
+	rgb := withTiles(grayIFD(16, 16, 16), make([]byte, 16*16*3))
+	rgb.SamplesPerPixel = 3
+	rgb.BitsPerSample = []uint16{8, 8, 8}
+	rgb.SampleFormat = []uint16{1, 1, 1}
+	rgb.PhotometricInterpretation = photometricInterpretationRGB
+	rgb.GDALMetaData = "<GDALMetadata>\n" +
+		"  <Item name=\"AREA\">Toulouse</Item>\n" +
+		"  <Item name=\"DESCRIPTION\" sample=\"0\" role=\"description\">red</Item>\n" +
+		"  <Item name=\"STATISTICS_MAXIMUM\" sample=\"0\">200</Item>\n" +
+		"  <Item name=\"DESCRIPTION\" sample=\"2\" role=\"description\">blue</Item>\n" +
+		"  <Item name=\"SCALE\" sample=\"1\" role=\"scale\">2</Item>\n" +
+		"  <Item name=\"DESCRIPTION\" sample=\"5\" role=\"description\">stale</Item>\n" +
+		"</GDALMetadata>\n"
+	cfg.BandOrder = []int{2, 0, 1}
+	buf.Reset()
+	if err := cfg.Rewrite(&buf, bytes.NewReader(encodeTIFF(t, rgb))); err != nil {
+		t.Fatal(err)
+	}
+	expected := "<GDALMetadata>\n" +
+		"  <Item name=\"AREA\">Toulouse</Item>\n" +
+		"  <Item name=\"DESCRIPTION\" sample=\"1\" role=\"description\">red</Item>\n" +
+		"  <Item name=\"STATISTICS_MAXIMUM\" sample=\"1\">200</Item>\n" +
+		"  <Item name=\"DESCRIPTION\" sample=\"0\" role=\"description\">blue</Item>\n" +
+		"  <Item name=\"SCALE\" sample=\"2\" role=\"scale\">2</Item>\n" +
+		"</GDALMetadata>\n"
+	if md := parseIFDs(t, buf.Bytes())[0].GDALMetaData; md != expected {
+		t.Errorf("unexpected band metadata %q", md)
+	}
+}
+
+func TestForcePlanarConfig(t *testing.T) {
+	src, err := os.ReadFile("testdata/rgb.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.ForcePlanarConfig = planarConfigurationSeparate
+	cfg.PlanarInterleaving = BandMajorInterleaving(3, false)
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	in, out := parseIFDs(t, src), parseIFDs(t, buf.Bytes())
+	sortIFDs(in)
+	if len(in) != len(out) {
+		t.Fatalf("got %d ifds, expected %d", len(out), len(in))
+	}
+	for i := range in {
+		if out[i].PlanarConfiguration != planarConfigurationSeparate {
+			t.Fatalf("ifd %d: PlanarConfiguration=%d", i, out[i].PlanarConfiguration)
+		}
+		intiles, outtiles := decodedTiles(t, in[i]), decodedTiles(t, out[i])
+		if len(outtiles) != 3*len(intiles) {
+			t.Fatalf("ifd %d: got %d tiles, expected %d", i, len(outtiles), 3*len(intiles))
+		}
+		for j := range intiles {
+			for b := 0; b < 3; b++ {
+				plane := outtiles[b*len(intiles)+j]
+				for p := range plane {
+					if plane[p] != intiles[j][p*3+b] {
+						t.Fatalf("ifd %d tile %d band %d: pixel %d differs", i, j, b, p)
+					}
+				}
+			}
+		}
+	}
+
+	src, err = os.ReadFile("testdata/band4.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = DefaultConfig()
+	cfg.ForcePlanarConfig = planarConfigurationContig
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+		t.Error("expected an error converting separate planes to chunky tiles")
+	}
+}
+
+func TestColormapSize(t *testing.T) {
+	palette := func(entries int) []byte {
+		img := withTiles(grayIFD(16, 16, 16), make([]byte, 256))
+		img.PhotometricInterpretation = photometricInterpretationPalette
+		img.Colormap = make([]uint16, entries)
+		for i := range img.Colormap {
+			img.Colormap[i] = uint16(i)
+		}
+		return encodeTIFF(t, img)
+	}
+	buf := bytes.Buffer{}
+	if err := Rewrite(&buf, bytes.NewReader(palette(768))); err != nil {
+		t.Fatal(err)
+	}
+	if cm := parseIFDs(t, buf.Bytes())[0].Colormap; len(cm) != 768 || cm[767] != 767 {
+		t.Errorf("colormap not preserved, got %d entries", len(cm))
+	}
+	err := Rewrite(io.Discard, bytes.NewReader(palette(3*16)))
+	if err == nil || !strings.Contains(err.Error(), "invalid colormap of 48 entries for a 8 bit palette image") {
+		t.Errorf("expected a colormap size error, got %v", err)
+	}
+}
+
+func TestPhotometric(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	for _, tc := range []struct{ from, to uint16 }{
+		{photometricInterpretationMinIsBlack, photometricInterpretationMinIsWhite},
+		{photometricInterpretationMinIsWhite, photometricInterpretationMinIsBlack},
+	} {
+		photometric := tc.to
+		cfg.Photometric = &photometric
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		in, out := parseIFDs(t, src), parseIFDs(t, buf.Bytes())
+		sortIFDs(in)
+		for i := range out {
+			expected := in[i].PhotometricInterpretation
+			if in[i].SubfileType&subfileTypeMask == 0 {
+				expected = tc.to
+			}
+			if out[i].PhotometricInterpretation != expected {
+				t.Errorf("ifd %d: photometric %d, expected %d", i, out[i].PhotometricInterpretation, expected)
+			}
+		}
+		src = buf.Bytes()
+	}
+
+	rgb := uint16(photometricInterpretationRGB)
+	cfg.Photometric = &rgb
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+		t.Error("expected an error setting RGB on a single band image")
+	}
+}
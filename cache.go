@@ -0,0 +1,80 @@
+package cogger
+
+import (
+	"container/list"
+	"sync"
+)
+
+// TileCache stores the raw tile data read from the source tiffs, so that
+// tiles that are accessed multiple times during a rewrite are only read once
+// from the underlying reader. Tiles are identified by the index of the reader
+// they were read from (as passed to Rewrite) and by their offset in that reader.
+type TileCache interface {
+	// Get returns the cached tile data, if any
+	Get(src int, offset uint64) ([]byte, bool)
+	// Put stores the tile data. The cache takes ownership of data
+	Put(src int, offset uint64, data []byte)
+}
+
+type tileKey struct {
+	src    int
+	offset uint64
+}
+
+type lruEntry struct {
+	key  tileKey
+	data []byte
+}
+
+type lruTileCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	size     int
+	ll       *list.List
+	entries  map[tileKey]*list.Element
+}
+
+// NewLRUTileCache returns a TileCache holding at most maxBytes of tile data,
+// evicting the least recently used tiles first
+func NewLRUTileCache(maxBytes int) TileCache {
+	return &lruTileCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[tileKey]*list.Element),
+	}
+}
+
+func (c *lruTileCache) Get(src int, offset uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[tileKey{src, offset}]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).data, true
+}
+
+func (c *lruTileCache) Put(src int, offset uint64, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := tileKey{src, offset}
+	if el, ok := c.entries[key]; ok {
+		c.size += len(data) - len(el.Value.(*lruEntry).data)
+		el.Value.(*lruEntry).data = data
+		c.ll.MoveToFront(el)
+	} else {
+		c.entries[key] = c.ll.PushFront(&lruEntry{key: key, data: data})
+		c.size += len(data)
+	}
+	for c.size > c.maxBytes {
+		el := c.ll.Back()
+		entry := el.Value.(*lruEntry)
+		c.ll.Remove(el)
+		delete(c.entries, entry.key)
+		c.size -= len(entry.data)
+	}
+}
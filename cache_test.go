@@ -0,0 +1,57 @@
+package cogger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestLRUTileCache(t *testing.T) {
+	c := NewLRUTileCache(10)
+	c.Put(0, 0, make([]byte, 4))
+	c.Put(1, 0, make([]byte, 4))
+	if _, ok := c.Get(0, 0); !ok {
+		t.Error("missing tile 0/0")
+	}
+	c.Put(0, 8, make([]byte, 4)) //evicts 1/0, which is the least recently used
+	if _, ok := c.Get(1, 0); ok {
+		t.Error("tile 1/0 not evicted")
+	}
+	if _, ok := c.Get(0, 0); !ok {
+		t.Error("tile 0/0 evicted")
+	}
+	c.Put(0, 16, make([]byte, 11))
+	if _, ok := c.Get(0, 16); ok {
+		t.Error("cached tile larger than cache")
+	}
+}
+
+func BenchmarkTileCache(b *testing.B) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, cached := range []bool{false, true} {
+		name := "nocache"
+		if cached {
+			name = "lru"
+		}
+		b.Run(name, func(b *testing.B) {
+			readAts := 0
+			for i := 0; i < b.N; i++ {
+				cfg := DefaultConfig()
+				cfg.DedupeTiles = true
+				if cached {
+					cfg.TileCache = NewLRUTileCache(1 << 20)
+				}
+				r := &countingReader{ReadAtReadSeeker: bytes.NewReader(src)}
+				if err := cfg.Rewrite(io.Discard, r); err != nil {
+					b.Fatal(err)
+				}
+				readAts += r.readAts
+			}
+			b.ReportMetric(float64(readAts)/float64(b.N), "readats/op")
+		})
+	}
+}
@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"hash"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 
 	"github.com/airbusgeo/cogger"
@@ -23,12 +29,36 @@ func main() {
 }
 
 func run(ctx context.Context) error {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		return inspect(os.Args[2:])
+	}
 	outfile := flag.String("output", "out.tif", "destination file")
+	endian := flag.String("endian", "", "byte order of the destination file (little|big), defaults to the one of the input")
+	checksum := flag.String("checksum", "", "print the md5 or sha256 checksum of the destination file, computed while writing it")
+	progress := flag.Bool("progress", false, "report the number of bytes written, and stop cleanly on interrupt")
+	retile := flag.String("retile", "", "decode the tiles and write them with the given WxH size (e.g. 512x512), for uncompressed, LZW or DEFLATE inputs without a predictor")
 	flag.Parse()
 
+	cfg := cogger.DefaultConfig()
+	switch *endian {
+	case "":
+	case "little":
+		cfg.Encoding = binary.LittleEndian
+	case "big":
+		cfg.Encoding = binary.BigEndian
+	default:
+		return fmt.Errorf("invalid endianness %q, must be one of little or big", *endian)
+	}
+	if *retile != "" {
+		if _, err := fmt.Sscanf(*retile, "%dx%d", &cfg.Retile[0], &cfg.Retile[1]); err != nil {
+			return fmt.Errorf("invalid tile size %q, must be WxH", *retile)
+		}
+	}
+
 	args := flag.Args()
 	if len(args) < 1 {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] file.tif [overview.tif...]\nOptions:\n", filepath.Base(os.Args[0]))
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] file.tif [overview.tif...]\n       %s inspect file.tif\nOptions:\n",
+			filepath.Base(os.Args[0]), filepath.Base(os.Args[0]))
 		flag.PrintDefaults()
 		return fmt.Errorf("")
 	}
@@ -48,11 +78,39 @@ func run(ctx context.Context) error {
 		totalSize += st.Size()
 		readers[i] = topFile
 	}
+	var h hash.Hash
+	switch *checksum {
+	case "":
+	case "md5":
+		h = md5.New()
+	case "sha256":
+		h = sha256.New()
+	default:
+		return fmt.Errorf("invalid checksum %q, must be one of md5 or sha256", *checksum)
+	}
 	out, err := os.Create(*outfile)
 	if err != nil {
 		return fmt.Errorf("create %s: %w", *outfile, err)
 	}
-	err = cogger.Rewrite(out, readers...)
+	var w io.Writer = out
+	if *progress {
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+		defer stop()
+		printed := int64(-1)
+		w = cogger.NewProgressWriter(ctx, out, func(n int64) {
+			if n>>20 != printed { //at most once per MB
+				printed = n >> 20
+				fmt.Fprintf(os.Stderr, "\rwritten %d of ~%d MB", n>>20, totalSize>>20)
+			}
+		})
+		defer fmt.Fprintln(os.Stderr)
+	}
+	if h != nil {
+		err = cfg.RewriteWithHash(w, h, readers...)
+	} else {
+		err = cfg.Rewrite(w, readers...)
+	}
 	if err != nil {
 		return fmt.Errorf("mucog write: %w", err)
 	}
@@ -60,5 +118,20 @@ func run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("close %s: %w", *outfile, err)
 	}
+	if h != nil {
+		fmt.Printf("%x  %s\n", h.Sum(nil), *outfile)
+	}
 	return nil
 }
+
+func inspect(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Usage: %s inspect file.tif\n", filepath.Base(os.Args[0]))
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("open %s: %w", args[0], err)
+	}
+	defer f.Close()
+	return cogger.Inspect(os.Stdout, f)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runArgs runs the cogger command with the given arguments
+func runArgs(args ...string) error {
+	os.Args = append([]string{"cogger"}, args...)
+	flag.CommandLine = flag.NewFlagSet("cogger", flag.ContinueOnError)
+	return run(context.Background())
+}
+
+func TestEndianFlag(t *testing.T) {
+	defer func(args []string, fs *flag.FlagSet) { os.Args, flag.CommandLine = args, fs }(os.Args, flag.CommandLine)
+	dir := t.TempDir()
+	for endian, magic := range map[string]string{"": "II", "little": "II", "big": "MM"} {
+		out := filepath.Join(dir, "out"+endian+".tif")
+		args := []string{"-output", out}
+		if endian != "" {
+			args = append(args, "-endian", endian)
+		}
+		if err := runArgs(append(args, "../../testdata/gray.tif")...); err != nil {
+			t.Fatalf("endian %q: %v", endian, err)
+		}
+		buf, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:2]) != magic {
+			t.Errorf("endian %q: got byte order %q, expected %q", endian, buf[:2], magic)
+		}
+	}
+	err := runArgs("-output", filepath.Join(dir, "out.tif"), "-endian", "middle", "../../testdata/gray.tif")
+	if err == nil || !strings.Contains(err.Error(), "invalid endianness") {
+		t.Errorf("expected an invalid endianness error, got %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package cogger
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/google/tiff"
+)
+
+const (
+	compressionNone         = 1
+	compressionLZW          = 5
+	compressionJPEG         = 7
+	compressionDeflate      = 8
+	compressionAdobeDeflate = 32946
+	compressionLERC         = 34887
+	compressionLZMA         = 34925
+	compressionZSTD         = 50000
+	compressionWEBP         = 50001
+	compressionJXL          = 50002
+)
+
+// decompress returns the decoded content of a tile compressed with the given
+// tiff compression scheme. size is the expected decoded size
+func decompress(compression uint16, data []byte, size int) ([]byte, error) {
+	var out []byte
+	switch compression {
+	case compressionNone:
+		out = data
+	case compressionLZW:
+		var err error
+		out, err = lzwDecode(data, size)
+		if err != nil {
+			return nil, fmt.Errorf("lzw: %w", err)
+		}
+	case compressionDeflate, compressionAdobeDeflate:
+		zr, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+		out = make([]byte, size)
+		if _, err = io.ReadFull(zr, out); err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", compression)
+	}
+	if len(out) < size {
+		return nil, fmt.Errorf("decoded %d bytes, expected %d", len(out), size)
+	}
+	return out[:size], nil
+}
+
+// compress encodes data with the given tiff compression scheme
+func compress(compression uint16, data []byte) ([]byte, error) {
+	switch compression {
+	case compressionNone:
+		return data, nil
+	case compressionLZW:
+		return lzwEncode(data), nil
+	case compressionDeflate, compressionAdobeDeflate:
+		buf := bytes.Buffer{}
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return nil, fmt.Errorf("deflate: %w", err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %d", compression)
+	}
+}
+
+// tiff flavored lzw: msb-first codes, starting at 9 bits and growing up to 12
+// bits one code earlier than the standard lzw variant
+const (
+	lzwClear    = 256
+	lzwEOI      = 257
+	lzwFirst    = 258
+	lzwMaxWidth = 12
+)
+
+func lzwDecode(data []byte, sizeHint int) ([]byte, error) {
+	out := make([]byte, 0, sizeHint)
+	table := make([][]byte, lzwFirst, 1<<lzwMaxWidth)
+	for i := 0; i < 256; i++ {
+		table[i] = []byte{byte(i)}
+	}
+	width := uint(9)
+	bits, nbits := uint32(0), uint(0)
+	prev := -1
+	for pos := 0; ; {
+		for nbits < width {
+			if pos >= len(data) {
+				return out, nil //missing EOI, tolerated
+			}
+			bits = bits<<8 | uint32(data[pos])
+			pos++
+			nbits += 8
+		}
+		code := int(bits>>(nbits-width)) & (1<<width - 1)
+		nbits -= width
+		switch {
+		case code == lzwClear:
+			table = table[:lzwFirst]
+			width = 9
+			prev = -1
+			continue
+		case code == lzwEOI:
+			return out, nil
+		case prev == -1:
+			if code >= lzwFirst {
+				return nil, fmt.Errorf("invalid code %d", code)
+			}
+			out = append(out, table[code]...)
+			prev = code
+			continue
+		}
+		var entry []byte
+		switch {
+		case code < len(table):
+			entry = table[code]
+			table = append(table, append(append([]byte{}, table[prev]...), entry[0]))
+		case code == len(table):
+			entry = append(append([]byte{}, table[prev]...), table[prev][0])
+			table = append(table, entry)
+		default:
+			return nil, fmt.Errorf("invalid code %d", code)
+		}
+		out = append(out, entry...)
+		prev = code
+		if len(table)+1 >= 1<<width && width < lzwMaxWidth {
+			width++
+		}
+	}
+}
+
+type lzwWriter struct {
+	out   []byte
+	bits  uint32
+	nbits uint
+}
+
+func (w *lzwWriter) put(code int, width uint) {
+	w.bits = w.bits<<width | uint32(code)
+	w.nbits += width
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.bits>>(w.nbits-8)))
+		w.nbits -= 8
+	}
+}
+
+func (w *lzwWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.bits<<(8-w.nbits)))
+		w.nbits = 0
+	}
+	return w.out
+}
+
+func lzwEncode(data []byte) []byte {
+	type key struct {
+		prefix int
+		c      byte
+	}
+	w := &lzwWriter{}
+	width := uint(9)
+	w.put(lzwClear, width)
+	if len(data) == 0 {
+		w.put(lzwEOI, width)
+		return w.flush()
+	}
+	dict := make(map[key]int)
+	next := lzwFirst
+	// emitted advances the table after a code has been written, emitting a clear
+	// code once it is full
+	emitted := func() {
+		next++
+		if next == 1<<lzwMaxWidth-2 {
+			w.put(lzwClear, width)
+			dict = make(map[key]int)
+			next = lzwFirst
+			width = 9
+		} else if next >= 1<<width {
+			width++
+		}
+	}
+	cur := int(data[0])
+	for _, c := range data[1:] {
+		if code, ok := dict[key{cur, c}]; ok {
+			cur = code
+			continue
+		}
+		w.put(cur, width)
+		dict[key{cur, c}] = next
+		emitted()
+		cur = int(c)
+	}
+	w.put(cur, width)
+	emitted()
+	w.put(lzwEOI, width)
+	return w.flush()
+}
+
+// undoHorizontalPredictor reverts the horizontal differencing of the decoded
+// tile pix, made of rows of width pixels of nsamples samples of size bytes each,
+// encoded with order
+func undoHorizontalPredictor(pix []byte, width, nsamples, size int, order binary.ByteOrder) error {
+	stride := width * nsamples * size
+	if stride == 0 {
+		return nil
+	}
+	for row := 0; row+stride <= len(pix); row += stride {
+		for i := nsamples * size; i < stride; i += size {
+			cur, prev := pix[row+i:row+i+size], pix[row+i-nsamples*size:row+i]
+			switch size {
+			case 1:
+				cur[0] += prev[0]
+			case 2:
+				order.PutUint16(cur, order.Uint16(cur)+order.Uint16(prev))
+			case 4:
+				order.PutUint32(cur, order.Uint32(cur)+order.Uint32(prev))
+			case 8:
+				order.PutUint64(cur, order.Uint64(cur)+order.Uint64(prev))
+			default:
+				return fmt.Errorf("unsupported %d byte samples for the horizontal predictor", size)
+			}
+		}
+	}
+	return nil
+}
+
+// transcodeTiles replaces the content of each non-empty tile of ifd by the result
+// of fn. The transcoded tiles are kept in memory
+func (ifd *ifd) transcodeTiles(fn func(idx int, tile []byte) ([]byte, error)) error {
+	data := []byte{}
+	offsets := make([]uint64, len(ifd.OriginalTileOffsets))
+	counts := make([]uint32, len(ifd.TileByteCounts))
+	for idx := range ifd.TileByteCounts {
+		bc := int(ifd.TileByteCounts[idx])
+		if bc == 0 {
+			continue
+		}
+		tile := make([]byte, bc)
+		if n, err := ifd.r.ReadAt(tile, int64(ifd.OriginalTileOffsets[idx])); n < bc {
+			return fmt.Errorf("read tile %d: %w", idx, err)
+		}
+		tile, err := fn(idx, tile)
+		if err != nil {
+			return fmt.Errorf("tile %d: %w", idx, err)
+		}
+		offsets[idx] = uint64(len(data))
+		counts[idx] = uint32(len(tile))
+		data = append(data, tile...)
+	}
+	ifd.OriginalTileOffsets = offsets
+	ifd.TileByteCounts = counts
+	ifd.r = tiff.NewBReader(bytes.NewReader(data), ifd.r.ByteOrder())
+	ifd.inMemory = true
+	return nil
+}
@@ -0,0 +1,125 @@
+package cogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/tiff"
+)
+
+func TestLZWDecode(t *testing.T) {
+	f, err := os.Open("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tif, err := tiff.Parse(f, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifd, err := loadIFD(tif.R(), tif.IFDs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for idx := range ifd.TileByteCounts {
+		tile := make([]byte, ifd.TileByteCounts[idx])
+		if _, err := f.ReadAt(tile, int64(ifd.OriginalTileOffsets[idx])); err != nil {
+			t.Fatal(err)
+		}
+		pix, err := decompress(compressionLZW, tile, 128*128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := byte(idx) * 2 //see testdata/main.go.removeme
+		for i := range pix {
+			if pix[i] != v*byte(i%4) {
+				t.Fatalf("tile %d: pixel %d is %d, expected %d", idx, i, pix[i], v*byte(i%4))
+			}
+		}
+		if !bytes.Equal(lzwEncode(pix), tile) {
+			t.Errorf("tile %d: encoding differs from libtiff", idx)
+		}
+	}
+}
+
+func TestCodecRoundtrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	rnd.Read(random)
+	lowEntropy := make([]byte, 300000)
+	for i := range lowEntropy {
+		lowEntropy[i] = byte(rnd.Intn(3))
+	}
+	for _, data := range [][]byte{{}, {42}, bytes.Repeat([]byte{7}, 100000), random, lowEntropy} {
+		for _, c := range []uint16{compressionNone, compressionLZW, compressionDeflate} {
+			enc, err := compress(c, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dec, err := decompress(c, enc, len(data))
+			if err != nil {
+				t.Fatalf("compression %d, size %d: %v", c, len(data), err)
+			}
+			if !bytes.Equal(dec, data) {
+				t.Errorf("compression %d, size %d: roundtrip mismatch", c, len(data))
+			}
+		}
+	}
+}
+
+// zstdFrame returns a zstd frame holding data (at most 128KB) in a single raw block
+func zstdFrame(data []byte) []byte {
+	frame := []byte{0x28, 0xb5, 0x2f, 0xfd, 0xa0, 0, 0, 0, 0} //magic, single segment with a 4 byte content size
+	binary.LittleEndian.PutUint32(frame[5:], uint32(len(data)))
+	hdr := uint32(len(data))<<3 | 1 //last raw block
+	frame = append(frame, byte(hdr), byte(hdr>>8), byte(hdr>>16))
+	return append(frame, data...)
+}
+
+func TestZSTDPassthrough(t *testing.T) {
+	tiles := [][]byte{}
+	for i := 0; i < 4; i++ {
+		tiles = append(tiles, zstdFrame(bytes.Repeat([]byte{byte(i)}, 16*16)))
+	}
+	main := withTiles(grayIFD(32, 32, 16), tiles...)
+	ovr := withTiles(grayIFD(16, 16, 16), zstdFrame(make([]byte, 16*16)))
+	for _, ifd := range []*ifd{main, ovr} {
+		ifd.Compression = 50000
+		ifd.Predictor = 2
+	}
+	src := encodeTIFF(t, withOverviews(main, ovr))
+
+	buf := bytes.Buffer{}
+	if err := Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	if len(ifds) != 2 {
+		t.Fatalf("got %d ifds, expected 2", len(ifds))
+	}
+	for l, ifd := range ifds {
+		if ifd.Compression != 50000 || ifd.Predictor != 2 {
+			t.Errorf("level %d: got compression %d and predictor %d", l, ifd.Compression, ifd.Predictor)
+		}
+	}
+	for i, tile := range tiles {
+		if !bytes.Equal(rawTile(t, ifds[0], i), tile) {
+			t.Errorf("tile %d not copied verbatim", i)
+		}
+	}
+	if err := AssertIdempotent(bytes.NewReader(src)); err != nil {
+		t.Error(err)
+	}
+
+	//zstd tiles cannot be decoded
+	cfg := DefaultConfig()
+	cfg.Retile = [2]int{32, 32}
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil || !strings.Contains(err.Error(), "unsupported compression 50000") {
+		t.Errorf("expected an unsupported compression error, got %v", err)
+	}
+}
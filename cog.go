@@ -2,9 +2,12 @@ package cogger
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"os"
+	"sort"
 
 	"github.com/google/tiff"
 	_ "github.com/google/tiff/bigtiff"
@@ -80,7 +83,11 @@ type ifd struct {
 	PhotometricInterpretation uint16   `tiff:"field,tag=262"`
 	DocumentName              string   `tiff:"field,tag=269"`
 	SamplesPerPixel           uint16   `tiff:"field,tag=277"`
+	MinSampleValue            []uint16 `tiff:"field,tag=280"`
+	MaxSampleValue            []uint16 `tiff:"field,tag=281"`
 	PlanarConfiguration       uint16   `tiff:"field,tag=284"`
+	PageNumber                []uint16 `tiff:"field,tag=297"`
+	TransferFunction          []uint16 `tiff:"field,tag=301"`
 	DateTime                  string   `tiff:"field,tag=306"`
 	Predictor                 uint16   `tiff:"field,tag=317"`
 	Colormap                  []uint16 `tiff:"field,tag=320"`
@@ -91,6 +98,11 @@ type ifd struct {
 	NewTileOffsets32          []uint32
 	TempTileByteCounts        []uint64 `tiff:"field,tag=325"`
 	TileByteCounts            []uint32
+	SubIFDs                   []uint64 `tiff:"field,tag=330"`
+	InkSet                    uint16   `tiff:"field,tag=332"`
+	InkNames                  string   `tiff:"field,tag=333"`
+	NumberOfInks              uint16   `tiff:"field,tag=334"`
+	DotRange                  []uint16 `tiff:"field,tag=336"`
 	ExtraSamples              []uint16 `tiff:"field,tag=338"`
 	SampleFormat              []uint16 `tiff:"field,tag=339"`
 	JPEGTables                []byte   `tiff:"field,tag=347"`
@@ -114,7 +126,13 @@ type ifd struct {
 	nplanes          uint64 //1 if PlanarConfiguration==1, SamplesPerPixel if PlanarConfiguration==2
 	tagsSize         uint64
 	strileSize       uint64
+	duplicates       map[uint64]bool              //tiles whose data is shared with a previously written tile
+	zeroed           map[uint64]bool              //unreadable tiles whose data is written as zeros
+	hashes           map[uint64][sha256.Size]byte //content of the readable tiles, when deduplicating
 	r                tiff.BReader
+	src              int  //index of the reader r was created from
+	input            int  //index of the ifd among all the input ifds
+	inMemory         bool //tile data has been transcoded, r does not read from the source
 }
 
 /*
@@ -132,14 +150,21 @@ func (ifd *IFD) StrileSize() uint64 {
 }
 */
 
+// AddOverview sets ovr as the reduced resolution image of ifd. Georeferencing
+// tags are cleared on the overview, including ModelTiePointTag arrays holding
+// multiple tie points (i.e. GCPs), see Config.KeepGCPsOnOverviews, and RPCs which
+// do not apply to decimated levels. The DocumentName is also cleared as it
+// usually refers to the overview's source file.
 func (ifd *ifd) AddOverview(ovr *ifd) {
 	ovr.SubfileType = subfileTypeReducedImage
+	ovr.DocumentName = ""
 	ovr.ModelPixelScaleTag = nil
 	ovr.ModelTiePointTag = nil
 	ovr.ModelTransformationTag = nil
 	ovr.GeoAsciiParamsTag = ""
 	ovr.GeoDoubleParamsTag = nil
 	ovr.GeoKeyDirectoryTag = nil
+	ovr.RPCs = nil
 	ifd.overview = ovr
 }
 func (ifd *ifd) AddMask(msk *ifd) error {
@@ -154,16 +179,47 @@ func (ifd *ifd) AddMask(msk *ifd) error {
 	default:
 		return fmt.Errorf("invalid subfiledtype")
 	}
+	msk.DocumentName = ""
 	msk.ModelPixelScaleTag = nil
 	msk.ModelTiePointTag = nil
 	msk.ModelTransformationTag = nil
 	msk.GeoAsciiParamsTag = ""
 	msk.GeoDoubleParamsTag = nil
 	msk.GeoKeyDirectoryTag = nil
+	msk.RPCs = nil
 	ifd.masks = append(ifd.masks, msk)
 	return nil
 }
 
+// hasGCPs returns true if the ifd's ModelTiePointTag contains more than a single
+// (I,J,K,X,Y,Z) tie point
+func (ifd *ifd) hasGCPs() bool {
+	return len(ifd.ModelTiePointTag) > 6
+}
+
+// scaledGCPs returns the ifd's tie points with their raster coordinates
+// expressed in the pixel space of ovr
+func (ifd *ifd) scaledGCPs(ovr *ifd) []float64 {
+	sx := float64(ovr.ImageWidth) / float64(ifd.ImageWidth)
+	sy := float64(ovr.ImageLength) / float64(ifd.ImageLength)
+	gcps := make([]float64, len(ifd.ModelTiePointTag))
+	copy(gcps, ifd.ModelTiePointTag)
+	for i := 0; i+5 < len(gcps); i += 6 {
+		gcps[i] *= sx
+		gcps[i+1] *= sy
+	}
+	return gcps
+}
+
+// planarConfiguration returns the ifd's PlanarConfiguration, defaulting to
+// chunky (as per the tiff spec) when the tag is absent
+func (ifd *ifd) planarConfiguration() uint16 {
+	if ifd.PlanarConfiguration == 0 {
+		return planarConfigurationContig
+	}
+	return ifd.PlanarConfiguration
+}
+
 func (ifd *ifd) structure(bigtiff bool) (tagCount, ifdSize, strileSize, planeCount uint64) {
 	cnt := uint64(0)
 	size := uint64(16) //8 for field count + 8 for next ifd offset
@@ -207,13 +263,29 @@ func (ifd *ifd) structure(bigtiff bool) (tagCount, ifdSize, strileSize, planeCou
 		cnt++
 		size += tagSize
 	}
+	if len(ifd.MinSampleValue) > 0 {
+		cnt++
+		size += arrayFieldSize(ifd.MinSampleValue, bigtiff)
+	}
+	if len(ifd.MaxSampleValue) > 0 {
+		cnt++
+		size += arrayFieldSize(ifd.MaxSampleValue, bigtiff)
+	}
 	if ifd.PlanarConfiguration > 0 {
 		cnt++
 		size += tagSize
 	}
-	if ifd.PlanarConfiguration == 2 {
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
 		planeCount = uint64(ifd.SamplesPerPixel)
 	}
+	if len(ifd.PageNumber) > 0 {
+		cnt++
+		size += arrayFieldSize(ifd.PageNumber, bigtiff)
+	}
+	if len(ifd.TransferFunction) > 0 {
+		cnt++
+		size += arrayFieldSize(ifd.TransferFunction, bigtiff)
+	}
 	if len(ifd.DateTime) > 0 {
 		cnt++
 		size += arrayFieldSize(ifd.DateTime, bigtiff)
@@ -248,6 +320,30 @@ func (ifd *ifd) structure(bigtiff bool) (tagCount, ifdSize, strileSize, planeCou
 		size += tagSize
 		strileSize += arrayFieldSize(ifd.TileByteCounts, bigtiff) - tagSize
 	}
+	if len(ifd.SubIFDs) > 0 {
+		cnt++
+		if bigtiff {
+			size += arrayFieldSize(ifd.SubIFDs, bigtiff)
+		} else {
+			size += arrayFieldSize(make([]uint32, len(ifd.SubIFDs)), bigtiff)
+		}
+	}
+	if ifd.InkSet > 0 {
+		cnt++
+		size += tagSize
+	}
+	if len(ifd.InkNames) > 0 {
+		cnt++
+		size += arrayFieldSize(ifd.InkNames, bigtiff)
+	}
+	if ifd.NumberOfInks > 0 {
+		cnt++
+		size += tagSize
+	}
+	if len(ifd.DotRange) > 0 {
+		cnt++
+		size += arrayFieldSize(ifd.DotRange, bigtiff)
+	}
 	if len(ifd.ExtraSamples) > 0 {
 		cnt++
 		size += arrayFieldSize(ifd.ExtraSamples, bigtiff)
@@ -303,19 +399,77 @@ func (ifd *ifd) structure(bigtiff bool) (tagCount, ifdSize, strileSize, planeCou
 	return cnt, size, strileSize, planeCount
 }
 
+// tagData accumulates out-of-line tag data that will be written at Offset.
+// If spillBytes is positive, the data is moved to a temporary file once it
+// grows past spillBytes, to bound memory usage.
 type tagData struct {
-	bytes.Buffer
-	Offset uint64
+	buf        bytes.Buffer
+	Offset     uint64
+	spillBytes int
+	file       *os.File
+	size       uint64
+	err        error //first write error, reported by WriteTo
 }
 
 func (t *tagData) NextOffset() uint64 {
-	return t.Offset + uint64(t.Buffer.Len())
+	return t.Offset + t.size
+}
+
+func (t *tagData) Write(p []byte) (int, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	t.size += uint64(len(p))
+	t.buf.Write(p)
+	if t.spillBytes > 0 && t.buf.Len() > t.spillBytes {
+		if t.file == nil {
+			t.file, t.err = os.CreateTemp("", "cogger-tagdata-*")
+			if t.err != nil {
+				return 0, t.err
+			}
+		}
+		if _, t.err = t.buf.WriteTo(t.file); t.err != nil {
+			return 0, t.err
+		}
+	}
+	return len(p), nil
+}
+
+// WriteTo writes all the accumulated data to w
+func (t *tagData) WriteTo(w io.Writer) (int64, error) {
+	if t.err != nil {
+		return 0, t.err
+	}
+	var n int64
+	if t.file != nil {
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		var err error
+		n, err = io.Copy(w, t.file)
+		if err != nil {
+			return n, err
+		}
+	}
+	m, err := t.buf.WriteTo(w)
+	return n + m, err
+}
+
+// Close removes the temporary file, if any
+func (t *tagData) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	t.file.Close()
+	return os.Remove(t.file.Name())
 }
 
 type cog struct {
 	enc     binary.ByteOrder
 	ifd     *ifd
 	bigtiff bool
+	cfg     Config
+	probed  bool //the tiles have been read once, see probeTiles
 }
 
 func new() *cog {
@@ -323,10 +477,7 @@ func new() *cog {
 }
 
 func (cog *cog) writeHeader(w io.Writer) error {
-	glen := uint64(len(ghost))
-	if len(cog.ifd.masks) > 0 {
-		glen = uint64(len(ghostmask))
-	}
+	glen := uint64(len(cog.ghost()))
 	var err error
 	if cog.bigtiff {
 		buf := [16]byte{}
@@ -354,11 +505,7 @@ func (cog *cog) writeHeader(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	if len(cog.ifd.masks) > 0 {
-		_, err = w.Write([]byte(ghostmask))
-	} else {
-		_, err = w.Write([]byte(ghost))
-	}
+	_, err = w.Write([]byte(cog.ghost()))
 	return err
 }
 
@@ -400,22 +547,62 @@ func (cog *cog) computeStructure() {
 	}
 }
 
-const ghost = `GDAL_STRUCTURAL_METADATA_SIZE=000140 bytes
-LAYOUT=IFDS_BEFORE_DATA
-BLOCK_ORDER=ROW_MAJOR
-BLOCK_LEADER=SIZE_AS_UINT4
-BLOCK_TRAILER=LAST_4_BYTES_REPEATED
-KNOWN_INCOMPATIBLE_EDITION=NO
-  ` //2 spaces: 1 for the gdal spec, and one to ensure the actual start offset is on a word boundary
+// ghost returns the gdal structural metadata to write after the tiff header
+func (cog *cog) ghost() string {
+	md := "LAYOUT=IFDS_BEFORE_DATA\nBLOCK_ORDER=ROW_MAJOR\n"
+	if !cog.cfg.DisableGhostBlockLeader {
+		md += "BLOCK_LEADER=SIZE_AS_UINT4\n"
+	}
+	if !cog.cfg.DisableGhostBlockTrailer {
+		md += "BLOCK_TRAILER=LAST_4_BYTES_REPEATED\n"
+	}
+	if cog.cfg.DedupeTiles || cog.cfg.MarkIncompatibleEdition || cog.cfg.DataOrder == FullResFirst {
+		//shared tile data, or full resolution data first, breaks the COG layout
+		md += "KNOWN_INCOMPATIBLE_EDITION=YES\n"
+	} else {
+		md += "KNOWN_INCOMPATIBLE_EDITION=NO\n " //extra space as per the gdal spec, leaves room for YES
+	}
+	pad := ""
+	if len(cog.ifd.masks) > 0 && cog.cfg.PlanarInterleaving.maskInterleaved(cog.ifd.planeCount()) {
+		md += "MASK_INTERLEAVED_WITH_IMAGERY=YES\n"
+	} else {
+		pad = " " //not accounted for in the size, ensures the actual start offset is on a word boundary
+	}
+	return fmt.Sprintf("GDAL_STRUCTURAL_METADATA_SIZE=%06d bytes\n", len(md)) + md + pad
+}
+
+// blockOverhead returns the number of bytes written before and after the data of each tile
+func (cog *cog) blockOverhead() (leader, trailer uint64) {
+	if !cog.cfg.DisableGhostBlockLeader {
+		leader = 4
+	}
+	if !cog.cfg.DisableGhostBlockTrailer {
+		trailer = 4
+	}
+	return
+}
 
-const ghostmask = `GDAL_STRUCTURAL_METADATA_SIZE=000174 bytes
-LAYOUT=IFDS_BEFORE_DATA
-BLOCK_ORDER=ROW_MAJOR
-BLOCK_LEADER=SIZE_AS_UINT4
-BLOCK_TRAILER=LAST_4_BYTES_REPEATED
-KNOWN_INCOMPATIBLE_EDITION=NO
- MASK_INTERLEAVED_WITH_IMAGERY=YES
-`
+// overflowsClassic returns true if the offset of the last tile, when the first one
+// is written at dataOffset, is certain to overflow a classic tiff. This holds when
+// even the largest tile being written last would not fit.
+func (cog *cog) overflowsClassic(dataOffset uint64) bool {
+	leader, trailer := cog.blockOverhead()
+	end, largest := dataOffset, uint64(0)
+	for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+		for _, cur := range append([]*ifd{lvl}, lvl.masks...) {
+			for _, cnt := range cur.TileByteCounts {
+				if cnt == 0 {
+					continue
+				}
+				end += uint64(cnt) + leader + trailer
+				if uint64(cnt) > largest {
+					largest = uint64(cnt)
+				}
+			}
+		}
+	}
+	return end-(largest+leader+trailer) > uint64(^uint32(0))
+}
 
 func (cog *cog) computeImageryOffsets() error {
 	ifd := cog.ifd
@@ -427,6 +614,7 @@ func (cog *cog) computeImageryOffsets() error {
 			ifd.NewTileOffsets32 = make([]uint32, len(ifd.OriginalTileOffsets))
 			ifd.NewTileOffsets64 = nil
 		}
+		ifd.duplicates = map[uint64]bool{}
 		//mifd.NewTileOffsets = mifd.OriginalTileOffsets
 		for _, sc := range ifd.masks {
 			if cog.bigtiff {
@@ -436,6 +624,7 @@ func (cog *cog) computeImageryOffsets() error {
 				sc.NewTileOffsets32 = make([]uint32, len(sc.OriginalTileOffsets))
 				sc.NewTileOffsets64 = nil
 			}
+			sc.duplicates = map[uint64]bool{}
 			//sc.NewTileOffsets = sc.OriginalTileOffsets
 		}
 		ifd = ifd.overview
@@ -443,47 +632,71 @@ func (cog *cog) computeImageryOffsets() error {
 	cog.computeStructure()
 
 	//offset to start of image data
-	dataOffset := uint64(16)
-	if !cog.bigtiff {
-		dataOffset = 8
-	}
-	if len(cog.ifd.masks) > 0 {
-		dataOffset += uint64(len(ghostmask)) + 4
-	} else {
-		dataOffset += uint64(len(ghost)) + 4
+	leader, trailer := cog.blockOverhead()
+	dataOffset := cog.headerSize() + leader
+
+	if err := cog.probeTiles(); err != nil {
+		return err
 	}
 
-	ifd = cog.ifd
-	for ifd != nil {
-		dataOffset += ifd.strileSize + ifd.tagsSize
-		for _, sc := range ifd.masks {
-			dataOffset += sc.strileSize + sc.tagsSize
+	if !cog.bigtiff && !cog.cfg.DedupeTiles && cog.overflowsClassic(dataOffset) {
+		//switch to bigtiff before iterating over the tiles, which is the costly part
+		if cog.cfg.NoBigTIFFPromotion {
+			return fmt.Errorf("tile offsets overflow a classic tiff")
 		}
-		ifd = ifd.overview
+		cog.bigtiff = true
+		return cog.computeImageryOffsets()
+	}
+
+	start := dataOffset - leader
+	var seen map[[sha256.Size]byte]uint64 //tile hash to offset of its data
+	if cog.cfg.DedupeTiles {
+		seen = make(map[[sha256.Size]byte]uint64)
 	}
 
 	datas := cog.dataInterlacing()
-	tiles := datas.tiles()
+	tiles := datas.tiles(cog.cfg.PlanarInterleaving)
 	for tile := range tiles {
-		tileidx := (tile.x+tile.y*tile.ifd.ntilesx)*tile.ifd.nplanes + tile.plane
+		tileidx := tile.idx
 		cnt := uint64(tile.ifd.TileByteCounts[tileidx])
+		if cog.cfg.MaxTileBytes > 0 && cnt > uint64(cog.cfg.MaxTileBytes) {
+			for range tiles {
+				//skip
+			}
+			return fmt.Errorf("ifd %dx%d (subfiletype %d): tile %d has size %d, larger than the maximum %d",
+				tile.ifd.ImageWidth, tile.ifd.ImageLength, tile.ifd.SubfileType, tileidx, cnt, cog.cfg.MaxTileBytes)
+		}
 		if cnt > 0 {
+			tileOffset := dataOffset
+			if h, ok := tile.ifd.hashes[tileidx]; ok && seen != nil {
+				if off, ok := seen[h]; ok {
+					tileOffset = off
+					tile.ifd.duplicates[tileidx] = true
+				} else {
+					seen[h] = dataOffset
+				}
+			}
 			if cog.bigtiff {
-				tile.ifd.NewTileOffsets64[tileidx] = dataOffset
+				tile.ifd.NewTileOffsets64[tileidx] = tileOffset
 			} else {
-				if dataOffset > uint64(^uint32(0)) { //^uint32(0) is max uint32
+				if tileOffset > uint64(^uint32(0)) { //^uint32(0) is max uint32
 					//rerun with bigtiff support
 
 					//first empty out the tiles channel to avoid a goroutine leak
 					for range tiles {
 						//skip
 					}
+					if cog.cfg.NoBigTIFFPromotion {
+						return fmt.Errorf("tile offset %d overflows a classic tiff", tileOffset)
+					}
 					cog.bigtiff = true
 					return cog.computeImageryOffsets()
 				}
-				tile.ifd.NewTileOffsets32[tileidx] = uint32(dataOffset)
+				tile.ifd.NewTileOffsets32[tileidx] = uint32(tileOffset)
+			}
+			if !tile.ifd.duplicates[tileidx] {
+				dataOffset += cnt + leader + trailer
 			}
-			dataOffset += uint64(tile.ifd.TileByteCounts[tileidx]) + 8
 		} else {
 			if cog.bigtiff {
 				tile.ifd.NewTileOffsets64[tileidx] = 0
@@ -493,27 +706,239 @@ func (cog *cog) computeImageryOffsets() error {
 		}
 	}
 
+	if cog.cfg.VerifyOffsets {
+		return cog.verifyOffsets(start)
+	}
+	return nil
+}
+
+// verifyOffsets checks that the data of the non-duplicate tiles, including their
+// block leader and trailer, are laid out after start in strictly increasing
+// order without overlapping
+func (cog *cog) verifyOffsets(start uint64) error {
+	leader, trailer := cog.blockOverhead()
+	type span struct {
+		ifd        *ifd
+		idx        uint64
+		begin, end uint64
+	}
+	prev := span{begin: start, end: start}
+	tiles := cog.dataInterlacing().tiles(cog.cfg.PlanarInterleaving)
+	for tile := range tiles {
+		cnt := uint64(tile.ifd.TileByteCounts[tile.idx])
+		if cnt == 0 || tile.ifd.duplicates[tile.idx] {
+			continue
+		}
+		off := uint64(0)
+		if cog.bigtiff {
+			off = tile.ifd.NewTileOffsets64[tile.idx]
+		} else {
+			off = uint64(tile.ifd.NewTileOffsets32[tile.idx])
+		}
+		cur := span{tile.ifd, tile.idx, off - leader, off + cnt + trailer}
+		if off < leader || cur.begin < prev.end {
+			for range tiles {
+				//skip
+			}
+			if prev.ifd == nil {
+				return fmt.Errorf("tile %d of ifd %dx%d at [%d,%d) starts before the tile data at %d",
+					cur.idx, cur.ifd.ImageWidth, cur.ifd.ImageLength, cur.begin, cur.end, start)
+			}
+			return fmt.Errorf("tile %d of ifd %dx%d at [%d,%d) overlaps tile %d of ifd %dx%d at [%d,%d)",
+				cur.idx, cur.ifd.ImageWidth, cur.ifd.ImageLength, cur.begin, cur.end,
+				prev.idx, prev.ifd.ImageWidth, prev.ifd.ImageLength, prev.begin, prev.end)
+		}
+		prev = cur
+	}
 	return nil
 }
 
+// verifyLayout checks that the header written by writeIFDs, of headerLen bytes,
+// ends exactly where the data of the first written tile (including its block
+// leader) starts
+func (cog *cog) verifyLayout(headerLen uint64) error {
+	leader, _ := cog.blockOverhead()
+	tiles := cog.dataInterlacing().tiles(cog.cfg.PlanarInterleaving)
+	for tile := range tiles {
+		if tile.ifd.TileByteCounts[tile.idx] == 0 || tile.ifd.duplicates[tile.idx] {
+			continue
+		}
+		for range tiles {
+			//skip
+		}
+		off := uint64(0)
+		if cog.bigtiff {
+			off = tile.ifd.NewTileOffsets64[tile.idx]
+		} else {
+			off = uint64(tile.ifd.NewTileOffsets32[tile.idx])
+		}
+		if off != headerLen+leader {
+			return fmt.Errorf("header ends at %d, but tile %d of ifd %dx%d starts at %d with a %d byte leader",
+				headerLen, tile.idx, tile.ifd.ImageWidth, tile.ifd.ImageLength, off, leader)
+		}
+		return nil
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	return n, err
+}
+
 func (cog *cog) write(out io.Writer) error {
 
 	err := cog.computeImageryOffsets()
 	if err != nil {
 		return err
 	}
+	cw := &countingWriter{w: out}
+	err = cog.writeIFDs(cw)
+	if err != nil {
+		return err
+	}
+	if cog.cfg.VerifyLayout {
+		if err = cog.verifyLayout(cw.n); err != nil {
+			return err
+		}
+	}
+	return cog.writeTiles(out)
+}
+
+// probeTiles reads all the tiles once when DedupeTiles or OnTileError require
+// it, before any offset is computed: unreadable tiles can then still be made
+// sparse, which is recorded in TileByteCounts (or in zeroed for WriteZeros) and
+// excluded from the classic tiff overflow check, and the content of readable
+// tiles is hashed for deduplication. The status of the tiles is kept when
+// offsets are computed again for a bigtiff
+func (cog *cog) probeTiles() error {
+	if cog.probed || (!cog.cfg.DedupeTiles && cog.cfg.OnTileError == nil) {
+		return nil
+	}
+	cog.probed = true
+	buf := []byte{}
+	tiles := cog.dataInterlacing().tiles(cog.cfg.PlanarInterleaving)
+	for tile := range tiles {
+		idx := tile.idx
+		cnt := uint64(tile.ifd.TileByteCounts[idx])
+		if cnt == 0 || (cog.cfg.MaxTileBytes > 0 && cnt > uint64(cog.cfg.MaxTileBytes)) {
+			continue //oversized tiles are reported when computing offsets
+		}
+		if uint64(len(buf)) < cnt {
+			buf = make([]byte, cnt)
+		}
+		err := cog.loadTile(tile.ifd, idx, buf[:cnt])
+		if err == nil {
+			if cog.cfg.DedupeTiles {
+				if tile.ifd.hashes == nil {
+					tile.ifd.hashes = map[uint64][sha256.Size]byte{}
+				}
+				tile.ifd.hashes[idx] = sha256.Sum256(buf[:cnt])
+			}
+			continue
+		}
+		switch cog.tileError(tile, err) {
+		case SkipAsSparse:
+			tile.ifd.TileByteCounts[idx] = 0
+		case WriteZeros:
+			if tile.ifd.zeroed == nil {
+				tile.ifd.zeroed = map[uint64]bool{}
+			}
+			tile.ifd.zeroed[idx] = true
+		default:
+			for range tiles {
+				//skip
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// headerSize returns the size of the tiff header, ghost area, ifds and strile
+// data, once computeStructure has been called
+func (cog *cog) headerSize() uint64 {
+	size := uint64(16)
+	if !cog.bigtiff {
+		size = 8
+	}
+	size += uint64(len(cog.ghost()))
+	for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+		size += ifd.strileSize + ifd.tagsSize
+		for _, sc := range ifd.masks {
+			size += sc.strileSize + sc.tagsSize
+		}
+	}
+	return size
+}
 
+// computeExistingOffsets sets the tile offsets of all ifds to their original
+// value shifted by base, for tile data that is not rewritten
+func (cog *cog) computeExistingOffsets(base uint64) error {
+	cog.bigtiff = false
+	ifds := []*ifd{}
+	for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+		ifds = append(ifds, ifd)
+		ifds = append(ifds, ifd.masks...)
+	}
+	for _, ifd := range ifds {
+		for _, off := range ifd.OriginalTileOffsets {
+			if off+base > uint64(^uint32(0)) {
+				if cog.cfg.NoBigTIFFPromotion {
+					return fmt.Errorf("tile offset %d overflows a classic tiff", off+base)
+				}
+				cog.bigtiff = true
+			}
+		}
+	}
+	first := ^uint64(0)
+	for _, ifd := range ifds {
+		ifd.NewTileOffsets32, ifd.NewTileOffsets64 = nil, nil
+		if cog.bigtiff {
+			ifd.NewTileOffsets64 = make([]uint64, len(ifd.OriginalTileOffsets))
+		} else {
+			ifd.NewTileOffsets32 = make([]uint32, len(ifd.OriginalTileOffsets))
+		}
+		for i, off := range ifd.OriginalTileOffsets {
+			if ifd.TileByteCounts[i] == 0 {
+				continue
+			}
+			if off+base < first {
+				first = off + base
+			}
+			if cog.bigtiff {
+				ifd.NewTileOffsets64[i] = off + base
+			} else {
+				ifd.NewTileOffsets32[i] = uint32(off + base)
+			}
+		}
+	}
+	cog.computeStructure()
+	leader, _ := cog.blockOverhead()
+	if size := cog.headerSize(); first != ^uint64(0) && first < size+leader {
+		return fmt.Errorf("the %d byte header overlaps the tile data at offset %d", size, first)
+	}
+	return nil
+}
+
+// writeIFDs writes the tiff header, ghost area, ifds and strile data. Tile offsets
+// must have been computed beforehand
+func (cog *cog) writeIFDs(out io.Writer) error {
 	//compute start of strile data, and offsets to subIFDs
 	//striles are placed after all ifds
-	strileData := &tagData{Offset: 16}
+	strileData := &tagData{Offset: 16, spillBytes: cog.cfg.MaxStrileDataBytes}
+	defer strileData.Close()
 	if !cog.bigtiff {
 		strileData.Offset = 8
 	}
-	if len(cog.ifd.masks) > 0 {
-		strileData.Offset += uint64(len(ghostmask))
-	} else {
-		strileData.Offset += uint64(len(ghost))
-	}
+	strileData.Offset += uint64(len(cog.ghost()))
 
 	ifd := cog.ifd
 	for ifd != nil {
@@ -524,26 +949,40 @@ func (cog *cog) write(out io.Writer) error {
 		ifd = ifd.overview
 	}
 
-	glen := uint64(len(ghost))
-	if len(cog.ifd.masks) > 0 {
-		glen = uint64(len(ghostmask))
+	glen := uint64(len(cog.ghost()))
+	err := cog.writeHeader(out)
+	if err != nil {
+		return fmt.Errorf("write header: %w", err)
 	}
-	cog.writeHeader(out)
 
 	ifd = cog.ifd
 	off := uint64(16 + glen)
 	if !cog.bigtiff {
 		off = 8 + glen
 	}
+	//with subifds, the overviews are not chained after the full resolution ifds
+	chained := cog.cfg.OverviewLayout != SubIFD
+	if len(cog.ifd.SubIFDs) > 0 {
+		ovrOff := off
+		i := 0
+		for ifd := cog.ifd; ifd.overview != nil; ifd = ifd.overview {
+			ovrOff += ifd.tagsSize
+			for _, si := range ifd.masks {
+				ovrOff += si.tagsSize
+			}
+			cog.ifd.SubIFDs[i] = ovrOff
+			i++
+		}
+	}
 	for ifd != nil {
 		nmasks := len(ifd.masks)
-		err := cog.writeIFD(out, ifd, off, strileData, nmasks > 0 || ifd.overview != nil)
+		err := cog.writeIFD(out, ifd, off, strileData, nmasks > 0 || (chained && ifd.overview != nil))
 		if err != nil {
 			return fmt.Errorf("write ifd: %w", err)
 		}
 		off += ifd.tagsSize
 		for i, si := range ifd.masks {
-			err := cog.writeIFD(out, si, off, strileData, i != nmasks-1 || ifd.overview != nil)
+			err := cog.writeIFD(out, si, off, strileData, i != nmasks-1 || (chained && ifd.overview != nil))
 			if err != nil {
 				return fmt.Errorf("write ifd: %w", err)
 			}
@@ -552,33 +991,51 @@ func (cog *cog) write(out io.Writer) error {
 		ifd = ifd.overview
 	}
 
-	_, err = out.Write(strileData.Bytes())
+	_, err = strileData.WriteTo(out)
 	if err != nil {
 		return fmt.Errorf("write strile pointers: %w", err)
 	}
+	return nil
+}
 
+// writeTiles writes the data of all tiles, in the order expected by computeImageryOffsets
+func (cog *cog) writeTiles(out io.Writer) error {
+	var err error
+	leader, trailer := cog.blockOverhead()
 	datas := cog.dataInterlacing()
-	tiles := datas.tiles()
+	tiles := datas.tiles(cog.cfg.PlanarInterleaving)
 	data := []byte{}
 	for tile := range tiles {
-		idx := (tile.x+tile.y*tile.ifd.ntilesx)*tile.ifd.nplanes + tile.plane
-		bc := tile.ifd.TileByteCounts[idx]
-		if bc > 0 {
-			_, err := tile.ifd.r.Seek(int64(tile.ifd.OriginalTileOffsets[idx]), io.SeekStart)
-			if err != nil {
-				return fmt.Errorf("seek to %d: %w", tile.ifd.OriginalTileOffsets[idx], err)
+		idx := tile.idx
+		bc := uint64(tile.ifd.TileByteCounts[idx])
+		if bc > 0 && !tile.ifd.duplicates[idx] {
+			need, limit := bc+8, uint64(cog.cfg.MaxTileBufferReuse)
+			if uint64(len(data)) < need || (limit > 0 && uint64(len(data)) > limit && need <= limit) {
+				size := need * 2
+				if limit > 0 && size > limit {
+					size = limit
+					if size < need {
+						size = need
+					}
+				}
+				data = make([]byte, size)
 			}
-			if uint32(len(data)) < bc+8 {
-				data = make([]byte, (bc+8)*2)
+			if leader > 0 {
+				cog.enc.PutUint32(data, uint32(bc)) //header ghost: tile size
 			}
-			binary.LittleEndian.PutUint32(data, bc) //header ghost: tile size
-			_, err = tile.ifd.r.Read(data[4 : 4+bc])
-			if err != nil {
-				return fmt.Errorf("read %d from %d: %w",
-					bc, tile.ifd.OriginalTileOffsets[idx], err)
+			if err := cog.readTile(tile, data[leader:leader+bc]); err != nil {
+				return err
 			}
-			copy(data[4+bc:8+bc], data[bc:4+bc]) //trailer ghost: repeat last 4 bytes
-			_, err = out.Write(data[0 : bc+8])
+			if trailer > 0 {
+				//trailer ghost: repeat last 4 bytes, zero padded in front for smaller tiles
+				last := bc
+				if last > 4 {
+					last = 4
+				}
+				zero(data[leader+bc : leader+bc+4-last])
+				copy(data[leader+bc+4-last:leader+bc+4], data[leader+bc-last:leader+bc])
+			}
+			_, err = out.Write(data[0 : leader+bc+trailer])
 			if err != nil {
 				return fmt.Errorf("write %d: %w", bc, err)
 			}
@@ -588,6 +1045,67 @@ func (cog *cog) write(out io.Writer) error {
 	return err
 }
 
+// writeDimension writes an ImageWidth or ImageLength entry, as a SHORT if it fits
+// and Config.ShortDimensions is set, as a LONG otherwise
+func (cog *cog) writeDimension(w io.Writer, tag uint16, value uint64) error {
+	if cog.cfg.ShortDimensions && value <= 0xffff {
+		return cog.writeField(w, tag, uint16(value))
+	}
+	return cog.writeField(w, tag, uint32(value))
+}
+
+// loadTile reads the data of tile idx of ifd into buf, which must be
+// TileByteCounts[idx] long
+func (cog *cog) loadTile(ifd *ifd, idx uint64, buf []byte) error {
+	off := ifd.OriginalTileOffsets[idx]
+	if cog.cfg.TileCache != nil && !ifd.inMemory {
+		if data, ok := cog.cfg.TileCache.Get(ifd.src, off); ok && len(data) == len(buf) {
+			copy(buf, data)
+			return nil
+		}
+	}
+	n, err := ifd.r.ReadAt(buf, int64(off))
+	if n < len(buf) {
+		return fmt.Errorf("read %d from %d: %w", len(buf), off, err)
+	}
+	if cog.cfg.TileCache != nil && !ifd.inMemory {
+		cog.cfg.TileCache.Put(ifd.src, off, append([]byte(nil), buf...))
+	}
+	return nil
+}
+
+// sortEntries reorders the encoded ifd entries according to cfg.TagOrder. Tags
+// absent from TagOrder are placed after the listed ones, in their original order
+func (cog *cog) sortEntries(entries []byte) []byte {
+	size := 12
+	if cog.bigtiff {
+		size = 20
+	}
+	rank := make(map[uint16]int, len(cog.cfg.TagOrder))
+	for i, tag := range cog.cfg.TagOrder {
+		rank[tag] = i
+	}
+	n := len(entries) / size
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	tagRank := func(i int) int {
+		if r, ok := rank[cog.enc.Uint16(entries[i*size:])]; ok {
+			return r
+		}
+		return len(rank)
+	}
+	sort.SliceStable(idx, func(i, j int) bool {
+		return tagRank(idx[i]) < tagRank(idx[j])
+	})
+	sorted := make([]byte, 0, len(entries))
+	for _, i := range idx {
+		sorted = append(sorted, entries[i*size:(i+1)*size]...)
+	}
+	return sorted
+}
+
 func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagData, next bool) error {
 
 	nextOff := uint64(0)
@@ -613,6 +1131,14 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 		return fmt.Errorf("write header: %w", err)
 	}
 
+	out := w
+	var entries *bytes.Buffer
+	if len(cog.cfg.TagOrder) > 0 {
+		//buffer the entries in order to reorder them once all have been written
+		entries = &bytes.Buffer{}
+		w = entries
+	}
+
 	if ifd.SubfileType > 0 {
 		err := cog.writeField(w, 254, ifd.SubfileType)
 		if err != nil {
@@ -620,13 +1146,13 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 		}
 	}
 	if ifd.ImageWidth > 0 {
-		err := cog.writeField(w, 256, uint32(ifd.ImageWidth))
+		err := cog.writeDimension(w, 256, ifd.ImageWidth)
 		if err != nil {
 			panic(err)
 		}
 	}
 	if ifd.ImageLength > 0 {
-		err := cog.writeField(w, 257, uint32(ifd.ImageLength))
+		err := cog.writeDimension(w, 257, ifd.ImageLength)
 		if err != nil {
 			panic(err)
 		}
@@ -667,6 +1193,22 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 		}
 	}
 
+	//MinSampleValue            []uint16 `tiff:"field,tag=280"`
+	if len(ifd.MinSampleValue) > 0 {
+		err := cog.writeArray(w, 280, ifd.MinSampleValue, overflow)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	//MaxSampleValue            []uint16 `tiff:"field,tag=281"`
+	if len(ifd.MaxSampleValue) > 0 {
+		err := cog.writeArray(w, 281, ifd.MaxSampleValue, overflow)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	//PlanarConfiguration       uint16   `tiff:"field,tag=284"`
 	if ifd.PlanarConfiguration > 0 {
 		err := cog.writeField(w, 284, ifd.PlanarConfiguration)
@@ -675,6 +1217,22 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 		}
 	}
 
+	//PageNumber                []uint16 `tiff:"field,tag=297"`
+	if len(ifd.PageNumber) > 0 {
+		err := cog.writeArray(w, 297, ifd.PageNumber, overflow)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	//TransferFunction          []uint16 `tiff:"field,tag=301"`
+	if len(ifd.TransferFunction) > 0 {
+		err := cog.writeArray(w, 301, ifd.TransferFunction, overflow)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	//DateTime                  string   `tiff:"field,tag=306"`
 	if len(ifd.DateTime) > 0 {
 		err := cog.writeArray(w, 306, ifd.DateTime, overflow)
@@ -736,6 +1294,55 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 		}
 	}
 
+	//SubIFDs                   []uint64 `tiff:"field,tag=330"`
+	if len(ifd.SubIFDs) > 0 {
+		var err error
+		if cog.bigtiff {
+			err = cog.writeArray(w, 330, ifd.SubIFDs, overflow)
+		} else {
+			subs := make([]uint32, len(ifd.SubIFDs))
+			for i := range subs {
+				subs[i] = uint32(ifd.SubIFDs[i])
+			}
+			err = cog.writeArray(w, 330, subs, overflow)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	//InkSet                    uint16   `tiff:"field,tag=332"`
+	if ifd.InkSet > 0 {
+		err := cog.writeField(w, 332, ifd.InkSet)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	//InkNames                  string   `tiff:"field,tag=333"`
+	if len(ifd.InkNames) > 0 {
+		err := cog.writeArray(w, 333, ifd.InkNames, overflow)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	//NumberOfInks              uint16   `tiff:"field,tag=334"`
+	if ifd.NumberOfInks > 0 {
+		err := cog.writeField(w, 334, ifd.NumberOfInks)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	//DotRange                  []uint16 `tiff:"field,tag=336"`
+	if len(ifd.DotRange) > 0 {
+		err := cog.writeArray(w, 336, ifd.DotRange, overflow)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	//ExtraSamples              []uint16 `tiff:"field,tag=338"`
 	if len(ifd.ExtraSamples) > 0 {
 		err := cog.writeArray(w, 338, ifd.ExtraSamples, overflow)
@@ -834,6 +1441,14 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 		}
 	}
 
+	if entries != nil {
+		w = out
+		_, err = w.Write(cog.sortEntries(entries.Bytes()))
+		if err != nil {
+			return fmt.Errorf("write entries: %w", err)
+		}
+	}
+
 	if cog.bigtiff {
 		err = binary.Write(w, cog.enc, nextOff)
 	} else {
@@ -842,7 +1457,7 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 	if err != nil {
 		return fmt.Errorf("write next: %w", err)
 	}
-	_, err = w.Write(overflow.Bytes())
+	_, err = overflow.WriteTo(w)
 	if err != nil {
 		return fmt.Errorf("write parea: %w", err)
 	}
@@ -851,12 +1466,35 @@ func (cog *cog) writeIFD(w io.Writer, ifd *ifd, offset uint64, striledata *tagDa
 
 type tile struct {
 	ifd   *ifd
+	idx   uint64 //index in the TileOffsets array
 	x, y  uint64
 	plane uint64
 }
 
+// tileIndex returns the index in the TileOffsets array of the tile at column x
+// and row y of the given plane. As per the tiff spec, the tiles of a
+// PlanarConfiguration=2 ifd are stored plane after plane.
+func (ifd *ifd) tileIndex(x, y, plane uint64) uint64 {
+	return plane*ifd.ntilesx*ifd.ntilesy + y*ifd.ntilesx + x
+}
+
+// tilePosition is the inverse of tileIndex
+func (ifd *ifd) tilePosition(idx uint64) (x, y, plane uint64) {
+	plane = idx / (ifd.ntilesx * ifd.ntilesy)
+	idx %= ifd.ntilesx * ifd.ntilesy
+	return idx % ifd.ntilesx, idx / ifd.ntilesx, plane
+}
+
+// newTile returns the tile stored at index idx of ifd
+func newTile(ifd *ifd, idx uint64) tile {
+	x, y, plane := ifd.tilePosition(idx)
+	return tile{ifd: ifd, idx: idx, x: x, y: y, plane: plane}
+}
+
 type datas [][]*ifd
 
+// dataInterlacing returns the image and mask ifds of each level, in the order
+// their data is written as per Config.DataOrder
 func (cog *cog) dataInterlacing() datas {
 	//count overviews
 	ifdo := cog.ifd
@@ -868,28 +1506,55 @@ func (cog *cog) dataInterlacing() datas {
 	ret := make([][]*ifd, count)
 	ifdo = cog.ifd
 	for idx := count - 1; idx >= 0; idx-- {
-		ret[idx] = append(ret[idx], ifdo)
-		ret[idx] = append(ret[idx], ifdo.masks...)
+		pos := idx
+		if cog.cfg.DataOrder == FullResFirst {
+			pos = count - 1 - idx
+		}
+		ret[pos] = append(ret[pos], ifdo)
+		ret[pos] = append(ret[pos], ifdo.masks...)
 		ifdo = ifdo.overview
 	}
 	return ret
 }
 
-func (d datas) tiles() chan tile {
+// tiles returns the tiles of all ifds, in the order they must be written.
+// Levels are written in the order of d, see dataInterlacing.
+// With a nil pi, the tiles of each ifd of a level are written in the order of
+// their TileOffsets array, interleaved with the mask tiles: the n-th group of
+// nplanes tiles of the image is followed by the n-th tile of each mask. Otherwise
+// the planes are grouped according to pi.
+func (d datas) tiles(pi PlanarInterleaving) chan tile {
 	ch := make(chan tile)
 	go func() {
 		defer close(ch)
 
 		for _, ovr := range d {
-			for y := uint64(0); y < ovr[0].ntilesy; y++ {
-				for x := uint64(0); x < ovr[0].ntilesx; x++ {
+			if pi == nil {
+				//TileOffsets order, i.e. band major for planar ifds
+				for i := uint64(0); i < ovr[0].ntilesx*ovr[0].ntilesy; i++ {
 					for _, ifd := range ovr {
 						for p := uint64(0); p < ifd.nplanes; p++ {
-							ch <- tile{
-								ifd:   ifd,
-								plane: p,
-								x:     x,
-								y:     y,
+							ch <- newTile(ifd, i*ifd.nplanes+p)
+						}
+					}
+				}
+				continue
+			}
+			nplanes := int(ovr[0].nplanes)
+			for _, group := range pi {
+				for y := uint64(0); y < ovr[0].ntilesy; y++ {
+					for x := uint64(0); x < ovr[0].ntilesx; x++ {
+						for _, p := range group {
+							if p < nplanes {
+								ch <- newTile(ovr[0], ovr[0].tileIndex(x, y, uint64(p)))
+								continue
+							}
+							if 1+p-nplanes >= len(ovr) {
+								continue //this level has fewer masks than others
+							}
+							msk := ovr[1+p-nplanes]
+							for mp := uint64(0); mp < msk.nplanes; mp++ {
+								ch <- newTile(msk, msk.tileIndex(x, y, mp))
 							}
 						}
 					}
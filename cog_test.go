@@ -0,0 +1,771 @@
+package cogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/tiff"
+)
+
+func TestDedupeTiles(t *testing.T) {
+	a := bytes.Repeat([]byte{1}, 256*256)
+	b := bytes.Repeat([]byte{2}, 256*256)
+	src := encodeTIFF(t, withTiles(grayIFD(512, 512, 256), a, a, b, a))
+
+	ref := bytes.Buffer{}
+	if err := Rewrite(&ref, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	cfg := DefaultConfig()
+	cfg.DedupeTiles = true
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != ref.Len()-2*(256*256+8) {
+		t.Errorf("got size %d, expected %d", buf.Len(), ref.Len()-2*(256*256+8))
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("KNOWN_INCOMPATIBLE_EDITION=YES\n")) {
+		t.Error("deduped cog not flagged as incompatible")
+	}
+	ifd := parseIFDs(t, buf.Bytes())[0]
+	off := ifd.OriginalTileOffsets
+	if off[0] != off[1] || off[0] != off[3] || off[0] == off[2] {
+		t.Errorf("unexpected offsets %v", off)
+	}
+	for i, exp := range [][]byte{a, a, b, a} {
+		if !bytes.Equal(buf.Bytes()[off[i]:off[i]+uint64(ifd.TileByteCounts[i])], exp) {
+			t.Errorf("tile %d content mismatch", i)
+		}
+	}
+}
+
+func TestPreservedTags(t *testing.T) {
+	rpcs := make([]float64, 92)
+	for i := range rpcs {
+		rpcs[i] = float64(i) + 0.5
+	}
+	dotRange := []uint16{0, 255, 0, 255, 0, 255, 0, 255}
+	for _, tc := range []struct {
+		name  string
+		setup func(main, ovr *ifd)
+		check func(main, ovr *ifd) bool
+	}{
+		{"grayscale response",
+			func(main, ovr *ifd) {
+				main.MinSampleValue = []uint16{3}
+				main.MaxSampleValue = []uint16{250}
+				main.TransferFunction = make([]uint16, 256)
+				for i := range main.TransferFunction {
+					main.TransferFunction[i] = uint16(i * i)
+				}
+			},
+			func(main, ovr *ifd) bool {
+				return fmt.Sprint(main.MinSampleValue, main.MaxSampleValue) == "[3] [250]" &&
+					len(main.TransferFunction) == 256 && main.TransferFunction[255] == 255*255
+			}},
+		{"overview DocumentName",
+			func(main, ovr *ifd) {
+				main.DocumentName = "main.tif"
+				ovr.DocumentName = "/tmp/strip-1.tif"
+			},
+			func(main, ovr *ifd) bool {
+				return main.DocumentName == "main.tif" && ovr.DocumentName == ""
+			}},
+		{"rpcs",
+			func(main, ovr *ifd) {
+				main.RPCs = rpcs
+				ovr.RPCs = rpcs
+			},
+			func(main, ovr *ifd) bool {
+				return fmt.Sprint(main.RPCs) == fmt.Sprint(rpcs) && len(ovr.RPCs) == 0
+			}},
+		{"cmyk",
+			func(main, ovr *ifd) {
+				for _, lvl := range []*ifd{main, ovr} {
+					lvl.SamplesPerPixel = 4
+					lvl.BitsPerSample = []uint16{8, 8, 8, 8}
+					lvl.SampleFormat = []uint16{1, 1, 1, 1}
+					lvl.PhotometricInterpretation = photometricInterpretationSeparated
+				}
+				main.InkSet = 1
+				main.InkNames = "Cyan\x00Magenta\x00Yellow\x00Black\x00"
+				main.NumberOfInks = 4
+				main.DotRange = dotRange
+			},
+			func(main, ovr *ifd) bool {
+				return main.InkSet == 1 && main.NumberOfInks == 4 && fmt.Sprint(main.DotRange) == fmt.Sprint(dotRange) &&
+					strings.HasPrefix(main.InkNames, "Cyan\x00Magenta\x00Yellow\x00Black")
+			}},
+	} {
+		main := withTiles(grayIFD(512, 512, 256), []byte{1}, []byte{2}, []byte{3}, []byte{4})
+		ovr := withTiles(grayIFD(256, 256, 256), []byte{5})
+		tc.setup(main, ovr)
+		ifds := rewriteIFDs(t, DefaultConfig(), withOverviews(main, ovr))
+		if !tc.check(ifds[0], ifds[1]) {
+			t.Errorf("%s: tags not preserved", tc.name)
+		}
+	}
+}
+
+func TestBigEndian(t *testing.T) {
+	f, err := os.Open("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg := DefaultConfig()
+	cfg.Encoding = binary.BigEndian
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte{'M', 'M', 0, 42}) {
+		t.Fatalf("unexpected header %x", buf.Bytes()[:4])
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	for _, ifd := range ifds {
+		for i, off := range ifd.OriginalTileOffsets {
+			if leader := binary.BigEndian.Uint32(buf.Bytes()[off-4:]); leader != ifd.TileByteCounts[i] {
+				t.Errorf("block leader %d, expected %d", leader, ifd.TileByteCounts[i])
+			}
+		}
+	}
+	_, _ = f.Seek(0, io.SeekStart)
+	eq, diff, err := TilesEqual(f, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eq {
+		t.Error(diff)
+	}
+}
+
+func TestInvalidTileSize(t *testing.T) {
+	for _, size := range [][2]uint16{{250, 256}, {256, 8}} {
+		ifd := grayIFD(256, 256, 0)
+		ifd.TileWidth, ifd.TileLength = size[0], size[1]
+		tiles := make([][]byte, int((256+size[0]-1)/size[0])*int((256+size[1]-1)/size[1]))
+		for i := range tiles {
+			tiles[i] = []byte{1}
+		}
+		data := encodeTIFF(t, withTiles(ifd, tiles...))
+		if err := Rewrite(io.Discard, bytes.NewReader(data)); err == nil {
+			t.Errorf("tile size %v not rejected", size)
+		}
+	}
+}
+
+func TestGhostBlockOverhead(t *testing.T) {
+	src, err := os.ReadFile("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range [][2]bool{{true, true}, {true, false}, {false, true}, {false, false}} {
+		cfg := DefaultConfig()
+		cfg.DisableGhostBlockLeader, cfg.DisableGhostBlockTrailer = !opts[0], !opts[1]
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		out := buf.Bytes()
+		if bytes.Contains(out, []byte("BLOCK_LEADER")) != opts[0] || bytes.Contains(out, []byte("BLOCK_TRAILER")) != opts[1] {
+			t.Errorf("%v: ghost area does not match options", opts)
+		}
+		leader, trailer := uint64(0), uint64(0)
+		if opts[0] {
+			leader = 4
+		}
+		if opts[1] {
+			trailer = 4
+		}
+		//cog_gray.tif data order: overview tile, then the 4 fullres tiles
+		ifds := parseIFDs(t, out)
+		offs := append(ifds[1].OriginalTileOffsets, ifds[0].OriginalTileOffsets...)
+		cnts := append(ifds[1].TileByteCounts, ifds[0].TileByteCounts...)
+		for i := range offs {
+			end := offs[i] + uint64(cnts[i])
+			if opts[0] && binary.LittleEndian.Uint32(out[offs[i]-4:]) != cnts[i] {
+				t.Errorf("%v: tile %d: wrong block leader", opts, i)
+			}
+			if opts[1] && !bytes.Equal(out[end-4:end], out[end:end+4]) {
+				t.Errorf("%v: tile %d: wrong block trailer", opts, i)
+			}
+			next := uint64(len(out)) + leader
+			if i < len(offs)-1 {
+				next = offs[i+1]
+			}
+			if end+trailer+leader != next {
+				t.Errorf("%v: tile %d: inconsistent offsets %d/%d", opts, i, end, next)
+			}
+		}
+		eq, diff, err := TilesEqual(bytes.NewReader(src), bytes.NewReader(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !eq {
+			t.Errorf("%v: %s", opts, diff)
+		}
+	}
+}
+
+func TestGhostBlockZeroConfig(t *testing.T) {
+	src, err := os.ReadFile("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	if err := (Config{}).Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"BLOCK_LEADER=SIZE_AS_UINT4\n", "BLOCK_TRAILER=LAST_4_BYTES_REPEATED\n"} {
+		if !bytes.Contains(buf.Bytes(), []byte(entry)) {
+			t.Errorf("zero Config: missing %q", entry)
+		}
+	}
+}
+
+func TestGhostBlockTrailerSmallTiles(t *testing.T) {
+	img := withTiles(grayIFD(32, 16, 16), []byte{7, 8}, []byte{9})
+	src := encodeTIFF(t, img)
+	for _, leader := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.DisableGhostBlockLeader = !leader
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatalf("leader=%v: %v", leader, err)
+		}
+		out := buf.Bytes()
+		ifd := parseIFDs(t, out)[0]
+		for i, exp := range [][]byte{{0, 0, 7, 8}, {0, 0, 0, 9}} {
+			end := ifd.OriginalTileOffsets[i] + uint64(ifd.TileByteCounts[i])
+			if got := out[end : end+4]; !bytes.Equal(got, exp) {
+				t.Errorf("leader=%v: tile %d: trailer %v, expected %v", leader, i, got, exp)
+			}
+		}
+	}
+}
+
+func TestMaxTileBytes(t *testing.T) {
+	src := encodeTIFF(t, withTiles(grayIFD(512, 256, 256), make([]byte, 100), make([]byte, 1000)))
+	cfg := DefaultConfig()
+	cfg.MaxTileBytes = 500
+	err := cfg.Rewrite(io.Discard, bytes.NewReader(src))
+	if err == nil || err.Error() != "mucog write: ifd 512x256 (subfiletype 0): tile 1 has size 1000, larger than the maximum 500" {
+		t.Errorf("unexpected error %v", err)
+	}
+	cfg.MaxTileBytes = 1000
+	if err = cfg.Rewrite(io.Discard, bytes.NewReader(src)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyOffsets(t *testing.T) {
+	a := bytes.Repeat([]byte{1}, 256*256)
+	b := bytes.Repeat([]byte{2}, 256*256)
+	src := encodeTIFF(t, withTiles(grayIFD(512, 512, 256), a, b, a, b))
+	cfg := DefaultConfig()
+	cfg.VerifyOffsets = true
+	for _, dedupe := range []bool{false, true} {
+		cfg.DedupeTiles = dedupe
+		if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err != nil {
+			t.Errorf("dedupe=%v: %v", dedupe, err)
+		}
+	}
+
+	c := new()
+	c.cfg = DefaultConfig()
+	c.ifd = withTiles(grayIFD(512, 512, 256), a, b, a, b)
+	if err := c.computeImageryOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	start := uint64(c.ifd.NewTileOffsets32[0]) - 4
+	if err := c.verifyOffsets(start); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verifyOffsets(start + 1); err == nil {
+		t.Error("tile before the start of the data not detected")
+	}
+	//make the second tile overlap the trailer of the first one
+	c.ifd.NewTileOffsets32[1] -= 2
+	err := c.verifyOffsets(start)
+	if err == nil || !strings.Contains(err.Error(), "tile 1 of ifd 512x512") || !strings.Contains(err.Error(), "overlaps tile 0") {
+		t.Errorf("overlap not detected: %v", err)
+	}
+	//swap the last two tiles
+	c.ifd.NewTileOffsets32[1] += 2
+	c.ifd.NewTileOffsets32[2], c.ifd.NewTileOffsets32[3] = c.ifd.NewTileOffsets32[3], c.ifd.NewTileOffsets32[2]
+	if err := c.verifyOffsets(start); err == nil {
+		t.Error("decreasing offsets not detected")
+	}
+}
+
+func TestVerifyLayout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.VerifyLayout = true
+	for _, name := range []string{"gray.tif", "graymask.tif", "band4mask.tif", "exttest.tif"} {
+		src, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, layout := range []OverviewLayout{ChainedIFD, SubIFD} {
+			cfg.OverviewLayout = layout
+			if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			if _, err := cfg.RewriteDataThenHeader(io.Discard, bytes.NewReader(src)); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+
+	c := new()
+	c.cfg = DefaultConfig()
+	c.ifd = withTiles(grayIFD(512, 512, 256), make([]byte, 10), nil, make([]byte, 20), nil)
+	if err := c.computeImageryOffsets(); err != nil {
+		t.Fatal(err)
+	}
+	header := bytes.Buffer{}
+	if err := c.writeIFDs(&header); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verifyLayout(uint64(header.Len())); err != nil {
+		t.Fatal(err)
+	}
+	err := c.verifyLayout(uint64(header.Len()) - 2)
+	if err == nil || !strings.Contains(err.Error(), "tile 0 of ifd 512x512") {
+		t.Errorf("header size mismatch not detected: %v", err)
+	}
+}
+
+func TestTagOrder(t *testing.T) {
+	src, err := os.ReadFile("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.TagOrder = []uint16{262, 256}
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	tif, err := tiff.Parse(bytes.NewReader(buf.Bytes()), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ifd := range tif.IFDs() {
+		tags := []uint16{}
+		for _, f := range ifd.Fields() {
+			tags = append(tags, f.Tag().ID())
+		}
+		if tags[0] != 262 || tags[1] != 256 {
+			t.Errorf("ifd %d: unexpected tag order %v", i, tags)
+		}
+		for j := 3; j < len(tags); j++ {
+			if tags[j] < tags[j-1] {
+				t.Errorf("ifd %d: unlisted tags not sorted: %v", i, tags)
+			}
+		}
+	}
+	eq, diff, err := TilesEqual(bytes.NewReader(src), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eq {
+		t.Error(diff)
+	}
+}
+
+func TestGCPs(t *testing.T) {
+	gcps := []float64{
+		0, 0, 0, 10, 20, 0,
+		512, 0, 0, 11, 20, 0,
+		512, 512, 0, 11, 19, 0,
+	}
+	main := withTiles(grayIFD(512, 512, 256), []byte("t0"), []byte("t1"), []byte("t2"), []byte("t3"))
+	main.ModelTiePointTag = gcps
+	ovr := withTiles(grayIFD(256, 256, 256), []byte("o0"))
+	src := encodeTIFF(t, withOverviews(main, ovr))
+
+	for _, keep := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.KeepGCPsOnOverviews = keep
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		ifds := parseIFDs(t, buf.Bytes())
+		if fmt.Sprint(ifds[0].ModelTiePointTag) != fmt.Sprint(gcps) {
+			t.Errorf("keep=%v: main gcps %v", keep, ifds[0].ModelTiePointTag)
+		}
+		var expected []float64
+		if keep {
+			expected = []float64{
+				0, 0, 0, 10, 20, 0,
+				256, 0, 0, 11, 20, 0,
+				256, 256, 0, 11, 19, 0,
+			}
+		}
+		if fmt.Sprint(ifds[1].ModelTiePointTag) != fmt.Sprint(expected) {
+			t.Errorf("keep=%v: overview gcps %v", keep, ifds[1].ModelTiePointTag)
+		}
+	}
+}
+
+func TestSparseOverview(t *testing.T) {
+	main := withTiles(grayIFD(1024, 512, 256),
+		[]byte("t0"), []byte("t1"), []byte("t2"), []byte("t3"),
+		[]byte("t4"), []byte("t5"), []byte("t6"), []byte("t7"))
+	src := encodeTIFF(t, withOverviews(main, withTiles(grayIFD(512, 256, 256), nil, nil)))
+
+	buf := bytes.Buffer{}
+	if err := Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	for i := range ifds[1].TileByteCounts {
+		if ifds[1].TileByteCounts[i] != 0 || ifds[1].OriginalTileOffsets[i] != 0 {
+			t.Errorf("sparse tile %d: offset %d, size %d", i, ifds[1].OriginalTileOffsets[i], ifds[1].TileByteCounts[i])
+		}
+	}
+	//only the 8 full resolution tiles, with their 4 byte leader and trailer, follow the header
+	last := ifds[0].OriginalTileOffsets[len(ifds[0].OriginalTileOffsets)-1]
+	if uint64(buf.Len()) != last+2+4 {
+		t.Errorf("unexpected file size %d, last tile at %d", buf.Len(), last)
+	}
+	eq, diff, err := TilesEqual(bytes.NewReader(src), bytes.NewReader(buf.Bytes()))
+	if err != nil || !eq {
+		t.Errorf("%v %s", err, diff)
+	}
+}
+
+func TestNoBigTIFFPromotion(t *testing.T) {
+	for _, promote := range []bool{true, false} {
+		//4 tiles of 1.5GB: the last one starts just after the 4GB classic tiff limit
+		img := grayIFD(256, 1024, 256)
+		img.OriginalTileOffsets = []uint64{0, 0, 0, 0}
+		img.TileByteCounts = []uint32{3 << 29, 3 << 29, 3 << 29, 3 << 29}
+		c := new()
+		c.cfg = DefaultConfig()
+		c.cfg.MaxTileBytes = 0
+		c.cfg.NoBigTIFFPromotion = !promote
+		c.ifd = img
+		err := c.computeImageryOffsets()
+		if promote && (err != nil || !c.bigtiff) {
+			t.Errorf("expected promotion to bigtiff, got bigtiff=%v, err=%v", c.bigtiff, err)
+		}
+		if !promote && (err == nil || c.bigtiff) {
+			t.Errorf("expected an error, got bigtiff=%v, err=%v", c.bigtiff, err)
+		}
+	}
+}
+
+func TestSampleFormat(t *testing.T) {
+	signed := withTiles(grayIFD(256, 256, 256), []byte("t0"))
+	signed.SampleFormat = []uint16{sampleFormatInt}
+	missing := withTiles(grayIFD(256, 256, 256), []byte("t0"))
+	missing.SampleFormat = nil
+
+	for _, tc := range []struct {
+		img      *ifd
+		dflt     uint16
+		expected []uint16
+	}{
+		{signed, 0, []uint16{sampleFormatInt}},
+		{signed, sampleFormatUInt, []uint16{sampleFormatInt}},
+		{missing, 0, nil},
+		{missing, sampleFormatInt, []uint16{sampleFormatInt}},
+	} {
+		cfg := DefaultConfig()
+		cfg.DefaultSampleFormat = tc.dflt
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(encodeTIFF(t, tc.img))); err != nil {
+			t.Fatal(err)
+		}
+		ifds := parseIFDs(t, buf.Bytes())
+		if fmt.Sprint(ifds[0].SampleFormat) != fmt.Sprint(tc.expected) {
+			t.Errorf("source %v, default %d: got SampleFormat %v, expected %v",
+				tc.img.SampleFormat, tc.dflt, ifds[0].SampleFormat, tc.expected)
+		}
+	}
+}
+
+func TestMaxStrileDataBytes(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	for _, name := range []string{"band4mask.tif", "exttest.tif"} {
+		src, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := bytes.Buffer{}
+		if err := Rewrite(&ref, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		cfg := DefaultConfig()
+		cfg.MaxStrileDataBytes = 16
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), ref.Bytes()) {
+			t.Errorf("%s: output changed when spilling strile data", name)
+		}
+	}
+	if left, _ := os.ReadDir(tmp); len(left) > 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+}
+
+func TestTruncatedTileArrays(t *testing.T) {
+	//4 tiles declared as 512x768 (6 tiles)
+	data := encodeTIFF(t, withTiles(grayIFD(512, 512, 256), []byte("0"), []byte("1"), []byte("2"), []byte("3")))
+	setTag(t, data, 257, 768)
+	if err := Rewrite(io.Discard, bytes.NewReader(data)); err == nil {
+		t.Error("truncated tile arrays not rejected")
+	}
+
+	//2 chunky tiles declared as planar (4 tiles)
+	img := grayIFD(512, 256, 256)
+	img.SamplesPerPixel = 2
+	img.BitsPerSample = []uint16{8, 8}
+	img.SampleFormat = []uint16{1, 1}
+	data = encodeTIFF(t, withTiles(img, []byte("0"), []byte("1")))
+	setTag(t, data, 284, planarConfigurationSeparate)
+	if err := Rewrite(io.Discard, bytes.NewReader(data)); err == nil {
+		t.Error("tile arrays not accounting for planes not rejected")
+	}
+}
+
+func TestMarkIncompatibleEdition(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mark := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.MarkIncompatibleEdition = mark
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		ghost, err := readGhost(bytes.NewReader(buf.Bytes()), 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "KNOWN_INCOMPATIBLE_EDITION=NO\n "
+		if mark {
+			expected = "KNOWN_INCOMPATIBLE_EDITION=YES\n"
+		}
+		if !bytes.Contains([]byte(ghost), []byte(expected)) {
+			t.Errorf("mark=%v: unexpected ghost area %q", mark, ghost)
+		}
+		if !bytes.HasSuffix([]byte(ghost), []byte("MASK_INTERLEAVED_WITH_IMAGERY=YES\n")) {
+			t.Errorf("mark=%v: ghost area size header does not match its content: %q", mark, ghost)
+		}
+	}
+}
+
+// BenchmarkComputeOffsets lays out a 3 level pyramid of 1.3 million 8KB tiles,
+// which does not fit in a classic tiff
+func BenchmarkComputeOffsets(b *testing.B) {
+	var root, prev *ifd
+	for _, ntiles := range []uint64{1024, 512, 256} {
+		level := grayIFD(ntiles*256, ntiles*256, 256)
+		n := ntiles * ntiles
+		level.OriginalTileOffsets = make([]uint64, n)
+		level.TileByteCounts = make([]uint32, n)
+		for i := range level.TileByteCounts {
+			level.TileByteCounts[i] = 8192
+		}
+		if prev == nil {
+			root = level
+		} else {
+			level.SubfileType = subfileTypeReducedImage
+			prev.overview = level
+		}
+		prev = level
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := new()
+		c.cfg = DefaultConfig()
+		c.ifd = root
+		if err := c.computeImageryOffsets(); err != nil || !c.bigtiff {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTileIndex(t *testing.T) {
+	ifd := grayIFD(600, 300, 256)
+	ifd.SamplesPerPixel = 3
+	ifd.PlanarConfiguration = planarConfigurationSeparate
+	ifd.ntilesx, ifd.ntilesy = 3, 2
+	seen := map[uint64]bool{}
+	for p := uint64(0); p < 3; p++ {
+		for y := uint64(0); y < 2; y++ {
+			for x := uint64(0); x < 3; x++ {
+				idx := ifd.tileIndex(x, y, p)
+				if seen[idx] || idx >= 18 {
+					t.Fatalf("tile %d,%d of plane %d: invalid or duplicate index %d", x, y, p, idx)
+				}
+				seen[idx] = true
+				if tx, ty, tp := ifd.tilePosition(idx); tx != x || ty != y || tp != p {
+					t.Errorf("index %d: got position %d,%d,%d, expected %d,%d,%d", idx, tx, ty, tp, x, y, p)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkTileBufferReuse writes tiles alternating between 4MB and 4KB, with
+// and without a cap on the retained write buffer
+func BenchmarkTileBufferReuse(b *testing.B) {
+	level := grayIFD(256*64, 256, 256)
+	level.OriginalTileOffsets = make([]uint64, 64)
+	level.TileByteCounts = make([]uint32, 64)
+	for i := range level.TileByteCounts {
+		level.TileByteCounts[i] = 4096
+		if i%8 == 0 {
+			level.TileByteCounts[i] = 4 << 20
+		}
+	}
+	level.r = tiff.NewBReader(bytes.NewReader(make([]byte, 4<<20)), binary.LittleEndian)
+	for _, limit := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprintf("max=%d", limit), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := new()
+				c.cfg = DefaultConfig()
+				c.cfg.MaxTileBufferReuse = limit
+				c.ifd = level
+				if err := c.write(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUncompressedEdgeTiles(t *testing.T) {
+	//600x300 with 256x256 tiles: the right column and bottom row are partial
+	tiles := [][]byte{}
+	for i := 0; i < 3*2; i++ {
+		tile := make([]byte, 256*256)
+		for p := range tile {
+			tile[p] = byte(i + p)
+		}
+		tiles = append(tiles, tile)
+	}
+	src := encodeTIFF(t, withTiles(grayIFD(600, 300, 256), tiles...))
+	buf := bytes.Buffer{}
+	if err := Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	out := parseIFDs(t, buf.Bytes())[0]
+	if out.Compression != compressionNone {
+		t.Fatalf("compression %d", out.Compression)
+	}
+	for i, tile := range decodedTiles(t, out) {
+		if out.TileByteCounts[i] != 256*256 {
+			t.Errorf("tile %d: %d bytes, expected full tile size", i, out.TileByteCounts[i])
+		}
+		if !bytes.Equal(tile, tiles[i]) {
+			t.Errorf("tile %d: content differs", i)
+		}
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		leader bool
+		layout OverviewLayout
+	}{{true, ChainedIFD}, {false, ChainedIFD}, {true, SubIFD}} {
+		cfg := DefaultConfig()
+		cfg.DisableGhostBlockLeader = !tc.leader
+		cfg.OverviewLayout = tc.layout
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		size, err := HeaderSize(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := uint64(0)
+		for _, ifd := range parseIFDs(t, buf.Bytes()) {
+			for i, off := range ifd.OriginalTileOffsets {
+				if ifd.TileByteCounts[i] > 0 && (first == 0 || off < first) {
+					first = off
+				}
+			}
+		}
+		if tc.leader {
+			first -= 4
+		}
+		if uint64(size) != first {
+			t.Errorf("leader=%v layout=%d: header size %d, first tile data at %d", tc.leader, tc.layout, size, first)
+		}
+	}
+}
+
+func TestTileSizeChecks(t *testing.T) {
+	main := encodeTIFF(t, withTiles(grayIFD(512, 512, 256), []byte{1}, []byte{2}, []byte{3}, []byte{4}))
+	ovr128 := encodeTIFF(t, withTiles(grayIFD(256, 256, 128), []byte{5}, []byte{6}, []byte{7}, []byte{8}))
+	ovr256 := encodeTIFF(t, withTiles(grayIFD(256, 256, 256), []byte{5}))
+	for _, tc := range []struct {
+		ovr      []byte
+		required [2]int
+		uniform  bool
+		valid    bool
+	}{
+		{ovr128, [2]int{}, false, true},
+		{ovr128, [2]int{}, true, false},
+		{ovr128, [2]int{256, 256}, false, false},
+		{ovr256, [2]int{256, 256}, true, true},
+		{ovr256, [2]int{512, 512}, false, false},
+	} {
+		cfg := DefaultConfig()
+		cfg.RequiredTileSize = tc.required
+		cfg.UniformTileSize = tc.uniform
+		err := cfg.Rewrite(io.Discard, bytes.NewReader(main), bytes.NewReader(tc.ovr))
+		if (err == nil) != tc.valid {
+			t.Errorf("required=%v uniform=%v: got error %v", tc.required, tc.uniform, err)
+		}
+	}
+}
+
+func TestShortDimensions(t *testing.T) {
+	src := encodeTIFF(t, withTiles(grayIFD(70000, 16, 256), make([][]byte, 274)...))
+	for _, short := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.ShortDimensions = short
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		tif, err := tiff.Parse(bytes.NewReader(buf.Bytes()), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ifd := tif.IFDs()[0]
+		width, length := ifd.GetField(256).Type().ID(), ifd.GetField(257).Type().ID()
+		//3 is SHORT, 4 is LONG. The 70000 width never fits in a SHORT
+		if expected := map[bool]uint16{false: 4, true: 3}[short]; width != 4 || length != expected {
+			t.Errorf("short=%v: width type %d, length type %d", short, width, length)
+		}
+		if ifds := parseIFDs(t, buf.Bytes()); ifds[0].ImageWidth != 70000 || ifds[0].ImageLength != 16 {
+			t.Errorf("short=%v: size %dx%d", short, ifds[0].ImageWidth, ifds[0].ImageLength)
+		}
+	}
+}
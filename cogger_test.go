@@ -3,8 +3,11 @@ package cogger
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/google/tiff"
@@ -63,3 +66,290 @@ func TestMultiFiles(t *testing.T) {
 	testCase(t, "cog_ext_ovr.tif", "exttest.tif", "exttest.tif.ovr")
 	testCase(t, "cog_ext_multi.tif", "exttest.tif", "exttest.tif.2", "exttest.tif.4")
 }
+
+func TestGhostSize(t *testing.T) {
+	type variant struct {
+		name string
+		cfg  func(*Config)
+	}
+	variants := []variant{
+		{"default", func(*Config) {}},
+		{"noleader", func(c *Config) { c.DisableGhostBlockLeader = true }},
+		{"notrailer", func(c *Config) { c.DisableGhostBlockTrailer = true }},
+		{"noblockghost", func(c *Config) { c.DisableGhostBlockLeader, c.DisableGhostBlockTrailer = true, true }},
+		{"incompatible", func(c *Config) { c.MarkIncompatibleEdition = true }},
+		{"maskseparate", func(c *Config) { c.PlanarInterleaving = MaskSeparateInterleaving(1) }},
+	}
+	//single ifd, overviews without mask, overviews with mask
+	for _, name := range []string{"exttest.tif", "gray.tif", "graymask.tif"} {
+		src, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range variants {
+			if v.name == "maskseparate" && name != "graymask.tif" {
+				continue
+			}
+			cfg := DefaultConfig()
+			v.cfg(&cfg)
+			buf := bytes.Buffer{}
+			if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+				t.Fatalf("%s/%s: %v", name, v.name, err)
+			}
+			data := buf.Bytes()
+			start, first := 8, int(binary.LittleEndian.Uint32(data[4:]))
+			if binary.LittleEndian.Uint16(data[2:]) == 43 {
+				start, first = 16, int(binary.LittleEndian.Uint64(data[8:]))
+			}
+			size := 0
+			if _, err := fmt.Sscanf(string(data[start:]), "GDAL_STRUCTURAL_METADATA_SIZE=%06d bytes\n", &size); err != nil {
+				t.Fatalf("%s/%s: %v", name, v.name, err)
+			}
+			start += len("GDAL_STRUCTURAL_METADATA_SIZE=000000 bytes\n")
+			md := string(data[start : start+size])
+			if !strings.HasPrefix(md, "LAYOUT=IFDS_BEFORE_DATA\n") || !strings.HasSuffix(strings.TrimSuffix(md, " "), "\n") {
+				t.Errorf("%s/%s: size %d does not match the ghost content %q", name, v.name, size, md)
+			}
+			//only a single padding space may follow the accounted content
+			if pad := string(data[start+size : first]); pad != "" && pad != " " {
+				t.Errorf("%s/%s: unaccounted ghost content %q", name, v.name, pad)
+			}
+		}
+	}
+}
+
+func TestSingleIFD(t *testing.T) {
+	f, err := os.Open("testdata/exttest.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := bytes.Buffer{}
+	if err = Rewrite(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes()[8:], []byte("GDAL_STRUCTURAL_METADATA_SIZE=000140 bytes\n")) {
+		t.Error("missing ghost area")
+	}
+	tif, err := tiff.Parse(bytes.NewReader(buf.Bytes()), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tif.IFDs()) != 1 {
+		t.Fatalf("got %d ifds, expected 1", len(tif.IFDs()))
+	}
+	ifd, err := loadIFD(tif.R(), tif.IFDs()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ifd.TileWidth != 256 || len(ifd.TileByteCounts) != 1 {
+		t.Fatalf("unexpected tiling %d/%d", ifd.TileWidth, len(ifd.TileByteCounts))
+	}
+	off := ifd.OriginalTileOffsets[0]
+	if leader := binary.LittleEndian.Uint32(buf.Bytes()[off-4:]); leader != ifd.TileByteCounts[0] {
+		t.Errorf("block leader %d, expected %d", leader, ifd.TileByteCounts[0])
+	}
+	if uint64(buf.Len()) != off+uint64(ifd.TileByteCounts[0])+4 {
+		t.Errorf("unexpected trailing data")
+	}
+}
+
+// withTiles sets the content of the tiles of ifd
+func withTiles(ifd *ifd, tiles ...[]byte) *ifd {
+	data := []byte{}
+	ifd.OriginalTileOffsets = make([]uint64, len(tiles))
+	ifd.TileByteCounts = make([]uint32, len(tiles))
+	for i, tile := range tiles {
+		ifd.OriginalTileOffsets[i] = uint64(len(data))
+		ifd.TileByteCounts[i] = uint32(len(tile))
+		data = append(data, tile...)
+	}
+	ifd.r = tiff.NewBReader(bytes.NewReader(data), binary.LittleEndian)
+	return ifd
+}
+
+// grayIFD returns an uncompressed 8bit single band ifd
+func grayIFD(width, height uint64, tileSize uint16) *ifd {
+	return &ifd{
+		ImageWidth:                width,
+		ImageLength:               height,
+		BitsPerSample:             []uint16{8},
+		Compression:               1,
+		PhotometricInterpretation: photometricInterpretationMinIsBlack,
+		SamplesPerPixel:           1,
+		PlanarConfiguration:       planarConfigurationContig,
+		TileWidth:                 tileSize,
+		TileLength:                tileSize,
+		SampleFormat:              []uint16{sampleFormatUInt},
+	}
+}
+
+// encodeTIFF returns the tiff encoding of the ifd tree starting at root
+func encodeTIFF(t *testing.T, root *ifd) []byte {
+	t.Helper()
+	c := new()
+	c.cfg = DefaultConfig()
+	c.ifd = root
+	buf := bytes.Buffer{}
+	if err := c.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// parseIFDs loads all the ifds contained in the tiff encoded in data
+func parseIFDs(t *testing.T, data []byte) []*ifd {
+	t.Helper()
+	tif, err := tiff.Parse(bytes.NewReader(data), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifds, err := loadSingleTIFF(tif)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ifds
+}
+
+type countingReader struct {
+	tiff.ReadAtReadSeeker
+	readAts int
+}
+
+func (c *countingReader) ReadAt(buf []byte, off int64) (int, error) {
+	c.readAts++
+	return c.ReadAtReadSeeker.ReadAt(buf, off)
+}
+
+// failingReader fails the reads at offset bad after the first okReads ones
+type failingReader struct {
+	tiff.ReadAtReadSeeker
+	bad     int64
+	okReads int
+}
+
+func (f *failingReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off == f.bad {
+		if f.okReads == 0 {
+			return 0, fmt.Errorf("corrupt data at %d", off)
+		}
+		f.okReads--
+	}
+	return f.ReadAtReadSeeker.ReadAt(buf, off)
+}
+
+// decodedTiles returns the decompressed content of all the tiles of ifd
+func decodedTiles(t *testing.T, ifd *ifd) [][]byte {
+	t.Helper()
+	spp := int(ifd.SamplesPerPixel)
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
+		spp = 1
+	}
+	tiles := make([][]byte, len(ifd.TileByteCounts))
+	for i := range tiles {
+		pix, err := decompress(ifd.Compression, rawTile(t, ifd, i), int(ifd.TileWidth)*int(ifd.TileLength)*spp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiles[i] = pix
+	}
+	return tiles
+}
+
+// planePixels returns the decoded pixels of a plane of an 8 bit ifd, sparse tiles
+// being zero
+func planePixels(t *testing.T, ifd *ifd, plane int) []byte {
+	t.Helper()
+	psize := ifd.pixelSize()
+	tw, th := int(ifd.TileWidth), int(ifd.TileLength)
+	w, h := int(ifd.ImageWidth), int(ifd.ImageLength)
+	ntx, nty := (w+tw-1)/tw, (h+th-1)/th
+	pix := make([]byte, w*h*psize)
+	for ty := 0; ty < nty; ty++ {
+		for tx := 0; tx < ntx; tx++ {
+			idx := plane*ntx*nty + ty*ntx + tx
+			if ifd.TileByteCounts[idx] == 0 {
+				continue
+			}
+			dec, err := decompress(ifd.Compression, rawTile(t, ifd, idx), tw*th*psize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < th && ty*th+y < h; y++ {
+				n := tw
+				if tx*tw+n > w {
+					n = w - tx*tw
+				}
+				copy(pix[((ty*th+y)*w+tx*tw)*psize:], dec[y*tw*psize:(y*tw+n)*psize])
+			}
+		}
+	}
+	return pix
+}
+
+// setTag overwrites the inline SHORT or LONG value of tag in the first ifd of a
+// classic little endian tiff
+func setTag(t *testing.T, data []byte, tag uint16, value uint32) {
+	t.Helper()
+	off := binary.LittleEndian.Uint32(data[4:])
+	n := int(binary.LittleEndian.Uint16(data[off:]))
+	for e := 0; e < n; e++ {
+		entry := data[int(off)+2+e*12:]
+		if binary.LittleEndian.Uint16(entry) != tag {
+			continue
+		}
+		if binary.LittleEndian.Uint16(entry[2:]) == tShort {
+			binary.LittleEndian.PutUint16(entry[8:], uint16(value))
+		} else {
+			binary.LittleEndian.PutUint32(entry[8:], value)
+		}
+		return
+	}
+	t.Fatalf("tag %d not found", tag)
+}
+
+// withOverviews chains ovrs as the reduced resolution levels of main
+func withOverviews(main *ifd, ovrs ...*ifd) *ifd {
+	lvl := main
+	for _, ovr := range ovrs {
+		ovr.SubfileType |= subfileTypeReducedImage
+		lvl.overview = ovr
+		lvl = ovr
+	}
+	return main
+}
+
+// grayPyramid returns 16 pixel high gray levels of the given widths, with 1 byte
+// tiles, chained as the overviews of the first one
+func grayPyramid(widths ...uint64) *ifd {
+	levels := []*ifd{}
+	for _, w := range widths {
+		tiles := make([][]byte, (w+255)/256)
+		for i := range tiles {
+			tiles[i] = []byte{byte(i)}
+		}
+		levels = append(levels, withTiles(grayIFD(w, 16, 256), tiles...))
+	}
+	return withOverviews(levels[0], levels[1:]...)
+}
+
+// rawTile returns the data of tile idx of ifd, as stored in the file
+func rawTile(t *testing.T, ifd *ifd, idx int) []byte {
+	t.Helper()
+	data := make([]byte, ifd.TileByteCounts[idx])
+	if _, err := ifd.r.ReadAt(data, int64(ifd.OriginalTileOffsets[idx])); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// rewriteIFDs rewrites the tiff encoding of root with cfg, and returns the ifds
+// of the output
+func rewriteIFDs(t *testing.T, cfg Config, root *ifd) []*ifd {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(encodeTIFF(t, root))); err != nil {
+		t.Fatal(err)
+	}
+	return parseIFDs(t, buf.Bytes())
+}
@@ -0,0 +1,101 @@
+package cogger
+
+import "fmt"
+
+// CRSEncoding selects how a CRS is stored in the output file
+type CRSEncoding int
+
+const (
+	// CRSGeoKeys stores the CRS as GeoTIFF keys referencing its EPSG code
+	CRSGeoKeys CRSEncoding = iota
+	// CRSMetadata stores the CRS as GeoTIFF keys, as CRSGeoKeys, and also as a
+	// "CRS" item of the GDAL metadata for tools that do not parse GeoTIFF keys
+	CRSMetadata
+)
+
+// CRS is a coordinate reference system to be set on the output file, replacing
+// the one of the input. The raster type (i.e. PixelIsArea or PixelIsPoint) of the
+// input is kept
+type CRS struct {
+	// EPSG is the EPSG code of the CRS, which is required by all encodings
+	EPSG int
+	// Geographic must be set for geographic (i.e. lon/lat) CRSs, as opposed to
+	// projected ones
+	Geographic bool
+	// WKT, if set, is written instead of "EPSG:<code>" with the CRSMetadata
+	// encoding. It is ignored by the CRSGeoKeys encoding
+	WKT string
+	// Encoding selects how the CRS is stored
+	Encoding CRSEncoding
+}
+
+const (
+	geoKeyModelType      = 1024
+	geoKeyRasterType     = 1025
+	geoKeyGeographicType = 2048
+	geoKeyProjectedType  = 3072
+
+	modelTypeProjected    = 1
+	modelTypeGeographic   = 2
+	rasterTypePixelIsArea = 1
+)
+
+// rasterType returns the GTRasterTypeGeoKey value of the GeoKeyDirectoryTag
+// content keys, or PixelIsArea if it is not set
+func rasterType(keys []uint16) uint16 {
+	for i := 4; i+4 <= len(keys); i += 4 {
+		if keys[i] == geoKeyRasterType && keys[i+1] == 0 && keys[i+2] == 1 {
+			return keys[i+3]
+		}
+	}
+	return rasterTypePixelIsArea
+}
+
+// geoKeys returns the minimal GeoKeyDirectoryTag content describing crs, for an
+// image of the given raster type
+func (crs CRS) geoKeys(raster uint16) ([]uint16, error) {
+	if crs.EPSG <= 0 || crs.EPSG > 0xffff {
+		return nil, fmt.Errorf("invalid EPSG code %d", crs.EPSG)
+	}
+	model, key := uint16(modelTypeProjected), uint16(geoKeyProjectedType)
+	if crs.Geographic {
+		model, key = modelTypeGeographic, geoKeyGeographicType
+	}
+	return []uint16{
+		1, 1, 0, 3, //version 1.1.0, 3 keys
+		geoKeyModelType, 0, 1, model,
+		geoKeyRasterType, 0, 1, raster,
+		key, 0, 1, uint16(crs.EPSG),
+	}, nil
+}
+
+// metadata returns md with a CRS item describing crs
+func (crs CRS) metadata(md string) (string, error) {
+	value := crs.WKT
+	if value == "" {
+		value = fmt.Sprintf("EPSG:%d", crs.EPSG)
+	}
+	return AddMetadataDomain(md, "", map[string]string{"CRS": value})
+}
+
+// setCRS replaces the CRS of the ifd
+func (ifd *ifd) setCRS(crs CRS) error {
+	if crs.Encoding != CRSGeoKeys && crs.Encoding != CRSMetadata {
+		return fmt.Errorf("unknown crs encoding %d", crs.Encoding)
+	}
+	keys, err := crs.geoKeys(rasterType(ifd.GeoKeyDirectoryTag))
+	if err != nil {
+		return err
+	}
+	if crs.Encoding == CRSMetadata {
+		md, err := crs.metadata(ifd.GDALMetaData)
+		if err != nil {
+			return err
+		}
+		ifd.GDALMetaData = md
+	}
+	ifd.GeoKeyDirectoryTag = keys
+	ifd.GeoDoubleParamsTag = nil
+	ifd.GeoAsciiParamsTag = ""
+	return nil
+}
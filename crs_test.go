@@ -0,0 +1,88 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestCRS(t *testing.T) {
+	img := withTiles(grayIFD(256, 256, 256), []byte("t0"))
+	img.ModelPixelScaleTag = []float64{1, 1, 0}
+	img.ModelTiePointTag = []float64{0, 0, 0, 500000, 4000000, 0}
+	img.GeoKeyDirectoryTag = []uint16{1, 1, 0, 1, 3072, 0, 1, 32631}
+	img.GeoAsciiParamsTag = "WGS 84 / UTM zone 31N|"
+	img.GDALMetaData = "<GDALMetadata>\n  <Item name=\"FOO\">bar</Item>\n</GDALMetadata>\n"
+	src := encodeTIFF(t, img)
+	img.GeoKeyDirectoryTag = []uint16{1, 1, 0, 2, 1025, 0, 1, 2, 3072, 0, 1, 32631} //PixelIsPoint
+	point := encodeTIFF(t, img)
+
+	for _, tc := range []struct {
+		src  []byte
+		crs  CRS
+		keys []uint16
+		md   string
+	}{
+		{
+			crs:  CRS{EPSG: 4326, Geographic: true},
+			keys: []uint16{1, 1, 0, 3, 1024, 0, 1, 2, 1025, 0, 1, 1, 2048, 0, 1, 4326},
+			md:   img.GDALMetaData,
+		},
+		{
+			crs:  CRS{EPSG: 32632},
+			keys: []uint16{1, 1, 0, 3, 1024, 0, 1, 1, 1025, 0, 1, 1, 3072, 0, 1, 32632},
+			md:   img.GDALMetaData,
+		},
+		{
+			src:  point,
+			crs:  CRS{EPSG: 32632},
+			keys: []uint16{1, 1, 0, 3, 1024, 0, 1, 1, 1025, 0, 1, 2, 3072, 0, 1, 32632},
+			md:   img.GDALMetaData,
+		},
+		{
+			crs:  CRS{EPSG: 32632, Encoding: CRSMetadata},
+			keys: []uint16{1, 1, 0, 3, 1024, 0, 1, 1, 1025, 0, 1, 1, 3072, 0, 1, 32632},
+			md:   "<GDALMetadata>\n  <Item name=\"FOO\">bar</Item>\n  <Item name=\"CRS\">EPSG:32632</Item>\n</GDALMetadata>\n",
+		},
+		{
+			crs:  CRS{EPSG: 4326, Geographic: true, WKT: `GEOGCS["WGS 84"]`, Encoding: CRSMetadata},
+			keys: []uint16{1, 1, 0, 3, 1024, 0, 1, 2, 1025, 0, 1, 1, 2048, 0, 1, 4326},
+			md:   "<GDALMetadata>\n  <Item name=\"FOO\">bar</Item>\n  <Item name=\"CRS\">GEOGCS[&#34;WGS 84&#34;]</Item>\n</GDALMetadata>\n",
+		},
+	} {
+		cfg := DefaultConfig()
+		crs := tc.crs
+		cfg.CRS = &crs
+		if tc.src == nil {
+			tc.src = src
+		}
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(tc.src)); err != nil {
+			t.Fatalf("%+v: %v", tc.crs, err)
+		}
+		out := parseIFDs(t, buf.Bytes())[0]
+		if fmt.Sprint(out.GeoKeyDirectoryTag) != fmt.Sprint(tc.keys) {
+			t.Errorf("%+v: got geokeys %v, expected %v", tc.crs, out.GeoKeyDirectoryTag, tc.keys)
+		}
+		if out.GeoAsciiParamsTag != "" {
+			t.Errorf("%+v: stale GeoAsciiParamsTag %q", tc.crs, out.GeoAsciiParamsTag)
+		}
+		if out.GDALMetaData != tc.md {
+			t.Errorf("%+v: got metadata %q", tc.crs, out.GDALMetaData)
+		}
+		if len(out.ModelTiePointTag) != 6 {
+			t.Errorf("%+v: georeferencing lost", tc.crs)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.CRS = &CRS{EPSG: 100000}
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+		t.Error("expected an error for an invalid EPSG code")
+	}
+	cfg.CRS = &CRS{WKT: `GEOGCS["WGS 84"]`, Encoding: CRSMetadata}
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+		t.Error("expected an error for a missing EPSG code")
+	}
+}
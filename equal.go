@@ -0,0 +1,81 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/tiff"
+)
+
+// TilesEqual checks that the tiffs a and b contain the same tile payloads, regardless
+// of their layout (i.e. ordering of tiles and ifds, ghost area, bigtiff-ness). IFDs are
+// matched by dimensions and subfile type, and the raw (still compressed) bytes of each
+// tile are compared. When the tiffs differ, the returned string describes the first
+// encountered mismatch.
+func TilesEqual(a, b tiff.ReadAtReadSeeker) (bool, string, error) {
+	aifds, err := loadSortedIFDs(a)
+	if err != nil {
+		return false, "", fmt.Errorf("load a: %w", err)
+	}
+	bifds, err := loadSortedIFDs(b)
+	if err != nil {
+		return false, "", fmt.Errorf("load b: %w", err)
+	}
+	if len(aifds) != len(bifds) {
+		return false, fmt.Sprintf("ifd count %d != %d", len(aifds), len(bifds)), nil
+	}
+	var abuf, bbuf []byte
+	for i := range aifds {
+		ai, bi := aifds[i], bifds[i]
+		if ai.ImageWidth != bi.ImageWidth || ai.ImageLength != bi.ImageLength || ai.SubfileType != bi.SubfileType {
+			return false, fmt.Sprintf("ifd %d: %dx%d (type %d) != %dx%d (type %d)", i,
+				ai.ImageWidth, ai.ImageLength, ai.SubfileType,
+				bi.ImageWidth, bi.ImageLength, bi.SubfileType), nil
+		}
+		if ai.TileWidth != bi.TileWidth || ai.TileLength != bi.TileLength {
+			return false, fmt.Sprintf("ifd %d: tile size %dx%d != %dx%d", i,
+				ai.TileWidth, ai.TileLength, bi.TileWidth, bi.TileLength), nil
+		}
+		if len(ai.TileByteCounts) != len(bi.TileByteCounts) {
+			return false, fmt.Sprintf("ifd %d: tile count %d != %d", i,
+				len(ai.TileByteCounts), len(bi.TileByteCounts)), nil
+		}
+		ai.ntilesx = (ai.ImageWidth + uint64(ai.TileWidth) - 1) / uint64(ai.TileWidth)
+		ai.ntilesy = (ai.ImageLength + uint64(ai.TileLength) - 1) / uint64(ai.TileLength)
+		for idx := range ai.TileByteCounts {
+			x, y, plane := ai.tilePosition(uint64(idx))
+			if ai.TileByteCounts[idx] != bi.TileByteCounts[idx] {
+				return false, fmt.Sprintf("ifd %d plane %d tile (%d,%d): size %d != %d", i, plane, x, y,
+					ai.TileByteCounts[idx], bi.TileByteCounts[idx]), nil
+			}
+			n := int(ai.TileByteCounts[idx])
+			if len(abuf) < n {
+				abuf = make([]byte, n)
+				bbuf = make([]byte, n)
+			}
+			if rn, err := ai.r.ReadAt(abuf[:n], int64(ai.OriginalTileOffsets[idx])); rn < n {
+				return false, "", fmt.Errorf("read a ifd %d tile %d: %w", i, idx, err)
+			}
+			if rn, err := bi.r.ReadAt(bbuf[:n], int64(bi.OriginalTileOffsets[idx])); rn < n {
+				return false, "", fmt.Errorf("read b ifd %d tile %d: %w", i, idx, err)
+			}
+			if !bytes.Equal(abuf[:n], bbuf[:n]) {
+				return false, fmt.Sprintf("ifd %d plane %d tile (%d,%d): content differs", i, plane, x, y), nil
+			}
+		}
+	}
+	return true, "", nil
+}
+
+func loadSortedIFDs(r tiff.ReadAtReadSeeker) ([]*ifd, error) {
+	tif, err := tiff.Parse(r, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parse tiff: %w", err)
+	}
+	ifds, err := loadSingleTIFF(tif)
+	if err != nil {
+		return nil, err
+	}
+	sortIFDs(ifds)
+	return ifds, nil
+}
@@ -0,0 +1,44 @@
+package cogger
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestTilesEqual(t *testing.T) {
+	open := func(name string) *os.File {
+		f, err := os.Open("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	for _, name := range []string{"rgbmask.tif", "band4.tif", "gray.tif"} {
+		eq, diff, err := TilesEqual(open(name), open("cog_"+name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !eq {
+			t.Errorf("%s: %s", name, diff)
+		}
+	}
+	eq, diff, err := TilesEqual(open("gray.tif"), open("rgb.tif"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if eq || diff == "" {
+		t.Error("gray and rgb reported as equal")
+	}
+
+	a := encodeTIFF(t, withTiles(grayIFD(512, 256, 256), []byte{1, 2, 3}, []byte{4, 5, 6}))
+	b := encodeTIFF(t, withTiles(grayIFD(512, 256, 256), []byte{1, 2, 3}, []byte{4, 5, 7}))
+	_, diff, err = TilesEqual(bytes.NewReader(a), bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "ifd 0 plane 0 tile (1,0): content differs" {
+		t.Errorf("unexpected diff %q", diff)
+	}
+}
@@ -0,0 +1,152 @@
+package cogger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/google/tiff"
+)
+
+const (
+	httpBlockSize  = 64 * 1024
+	httpCacheSlots = 64
+)
+
+// httpReader reads a remote file with http range requests, keeping the last
+// fetched blocks in a small cache
+type httpReader struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	size   int64
+	pos    int64
+
+	mu     sync.Mutex
+	blocks map[int64][]byte
+	order  []int64 //cached block indexes, oldest first
+}
+
+// HTTPReader returns a reader of the file at url, for use with Rewrite and the
+// other functions taking tiff readers. Data is fetched with http range requests
+// by blocks of 64KB, and the last 64 blocks are cached. An error is returned if
+// the server does not support range requests.
+func HTTPReader(ctx context.Context, url string) (tiff.ReadAtReadSeeker, error) {
+	r := &httpReader{
+		ctx:    ctx,
+		client: http.DefaultClient,
+		url:    url,
+		blocks: make(map[int64][]byte),
+	}
+	//the first request also retrieves the file size from its Content-Range
+	if _, err := r.fetch(0); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Size returns the size of the remote file
+func (r *httpReader) Size() int64 {
+	return r.size
+}
+
+// fetch returns the content of block b. r.mu must be held
+func (r *httpReader) fetch(b int64) ([]byte, error) {
+	if data, ok := r.blocks[b]; ok {
+		return data, nil
+	}
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", b*httpBlockSize, (b+1)*httpBlockSize-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, fmt.Errorf("get %s: server does not support range requests", r.url)
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("get %s: %s", r.url, resp.Status)
+	}
+	var start, end, size int64
+	if _, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil {
+		return nil, fmt.Errorf("get %s: invalid Content-Range %q", r.url, resp.Header.Get("Content-Range"))
+	}
+	if start != b*httpBlockSize {
+		return nil, fmt.Errorf("get %s: got range starting at %d, expected %d", r.url, start, b*httpBlockSize)
+	}
+	data := make([]byte, end-start+1)
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("get %s: %w", r.url, err)
+	}
+	r.size = size
+	if len(r.order) >= httpCacheSlots {
+		delete(r.blocks, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.blocks[b] = data
+	r.order = append(r.order, b)
+	return data, nil
+}
+
+// ReadAt implements io.ReaderAt
+func (r *httpReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) {
+		cur := off + int64(n)
+		if cur >= r.size {
+			return n, io.EOF
+		}
+		data, err := r.fetch(cur / httpBlockSize)
+		if err != nil {
+			return n, err
+		}
+		boff := int(cur % httpBlockSize)
+		if boff >= len(data) {
+			return n, io.EOF
+		}
+		n += copy(p[n:], data[boff:])
+	}
+	return n, nil
+}
+
+// Read implements io.Reader
+func (r *httpReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (r *httpReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	r.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,76 @@
+package cogger
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHTTPReader(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "graymask.tif", time.Time{}, bytes.NewReader(src))
+	}))
+	defer srv.Close()
+
+	r, err := HTTPReader(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := r.(interface{ Size() int64 }).Size(); size != int64(len(src)) {
+		t.Errorf("size %d, expected %d", size, len(src))
+	}
+	local, remote := bytes.Buffer{}, bytes.Buffer{}
+	if err := Rewrite(&local, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rewrite(&remote, r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(local.Bytes(), remote.Bytes()) {
+		t.Error("rewriting the remote file differs from rewriting the local one")
+	}
+
+	noRange := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(src)
+	}))
+	defer noRange.Close()
+	if _, err := HTTPReader(context.Background(), noRange.URL); err == nil {
+		t.Error("expected an error for a server without range support")
+	}
+}
+
+func TestHTTPReaderBlocks(t *testing.T) {
+	data := make([]byte, 3*httpBlockSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+	r, err := HTTPReader(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rng := range [][2]int{{0, 10}, {httpBlockSize - 5, 10}, {10, 2*httpBlockSize + 100}, {len(data) - 100, 100}} {
+		buf := make([]byte, rng[1])
+		if _, err := r.ReadAt(buf, int64(rng[0])); err != nil {
+			t.Fatalf("read %v: %v", rng, err)
+		}
+		if !bytes.Equal(buf, data[rng[0]:rng[0]+rng[1]]) {
+			t.Errorf("read %v: content differs", rng)
+		}
+	}
+	buf := make([]byte, 200)
+	if n, err := r.ReadAt(buf, int64(len(data)-100)); n != 100 || err == nil {
+		t.Errorf("read past the end: got %d bytes and error %v", n, err)
+	}
+}
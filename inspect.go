@@ -0,0 +1,173 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/tiff"
+)
+
+// Inspect prints a description of the internal layout of the tiff read from r to w:
+// byte order, tiff flavor, ghost area content, a summary of each ifd in file order
+// (the ifds referenced by a SubIFDs tag following their parent, as when
+// rewriting), and the decimation factors between consecutive overview levels.
+// The output is line oriented, one property per line, and meant to be grepped.
+// Inconsistent ifds that Rewrite would refuse (e.g. because of their tile size)
+// are described anyway, followed by an "ifd N: invalid: ..." line.
+func Inspect(w io.Writer, r tiff.ReadAtReadSeeker) error {
+	tif, err := tiff.Parse(r, nil, nil)
+	if err != nil {
+		return fmt.Errorf("parse tiff: %w", err)
+	}
+	order := "little"
+	if tif.Order() == "MM" {
+		order = "big"
+	}
+	format := "classic"
+	hlen := int64(8)
+	if tif.Version() == 43 {
+		format = "bigtiff"
+		hlen = 16
+	}
+	fmt.Fprintf(w, "byteorder: %s\n", order)
+	fmt.Fprintf(w, "format: %s\n", format)
+
+	ghost, err := readGhost(r, hlen)
+	if err != nil {
+		return fmt.Errorf("read ghost area: %w", err)
+	}
+	if ghost == "" {
+		fmt.Fprintf(w, "ghost: no\n")
+	} else {
+		fmt.Fprintf(w, "ghost: yes\n")
+		for _, line := range strings.Split(ghost, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				fmt.Fprintf(w, "ghost.%s\n", line)
+			}
+		}
+	}
+
+	ifds, err := walkTIFF(tif, unmarshalIFD)
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	levels := []*ifd{}
+	for i, ifd := range ifds {
+		if ifd.SubfileType&subfileTypeMask == 0 {
+			levels = append(levels, ifd)
+		}
+		first, last := uint64(0), uint64(0)
+		for t, off := range ifd.OriginalTileOffsets {
+			if t < len(ifd.TileByteCounts) && ifd.TileByteCounts[t] == 0 {
+				continue
+			}
+			if first == 0 || off < first {
+				first = off
+			}
+			if off > last {
+				last = off
+			}
+		}
+		fmt.Fprintf(w, "ifd %d: size=%dx%d subfiletype=%d compression=%s tilesize=%dx%d tiles=%d first_offset=%d last_offset=%d\n",
+			i, ifd.ImageWidth, ifd.ImageLength, ifd.SubfileType, CompressionName(ifd.Compression),
+			ifd.TileWidth, ifd.TileLength, len(ifd.TileByteCounts), first, last)
+		if err := ifd.validate(); err != nil {
+			fmt.Fprintf(w, "ifd %d: invalid: %v\n", i, err)
+		}
+	}
+	if len(levels) > 1 {
+		sortIFDs(levels)
+		factors := []string{}
+		for _, f := range decimationFactors(levels) {
+			factors = append(factors, strconv.FormatFloat(f, 'f', 2, 64))
+		}
+		fmt.Fprintf(w, "decimation: %s\n", strings.Join(factors, " "))
+	}
+	return nil
+}
+
+// readGhost returns the content of the gdal structural metadata found after the
+// tiff header, or an empty string if there is none
+func readGhost(r io.ReaderAt, headerLen int64) (string, error) {
+	const prefix = "GDAL_STRUCTURAL_METADATA_SIZE="
+	buf := make([]byte, len(prefix)+13) //000000 bytes\n
+	if n, _ := r.ReadAt(buf, headerLen); n < len(buf) || !bytes.HasPrefix(buf, []byte(prefix)) {
+		return "", nil
+	}
+	size, err := strconv.Atoi(string(buf[len(prefix) : len(prefix)+6]))
+	if err != nil {
+		return "", fmt.Errorf("invalid ghost area size: %w", err)
+	}
+	content := make([]byte, size)
+	n, err := r.ReadAt(content, headerLen+int64(len(buf)))
+	if n < size {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// HeaderSize returns the number of bytes from the start of the tiff read from r
+// to the end of its ifds and of their out-of-line tag data (including the tile
+// offsets and byte counts arrays). For COGs, whose ghost area advertises
+// LAYOUT=IFDS_BEFORE_DATA, fetching that many bytes retrieves all the metadata
+// without any tile data.
+func HeaderSize(r tiff.ReadAtReadSeeker) (int64, error) {
+	tif, err := tiff.Parse(r, nil, nil)
+	if err != nil {
+		return 0, fmt.Errorf("parse tiff: %w", err)
+	}
+	entrySize, countSize := uint64(12), uint64(2)
+	if tif.Version() == 43 {
+		entrySize, countSize = 20, 8
+	}
+	end := uint64(0)
+	var measure func(tifd tiff.IFD, off uint64, depth int) error
+	measure = func(tifd tiff.IFD, off uint64, depth int) error {
+		size := countSize + tifd.NumEntries()*entrySize + uint64(tif.OffsetSize())
+		if off+size > end {
+			end = off + size
+		}
+		for _, f := range tifd.Fields() {
+			if o := f.Offset(); o > 0 && o+uint64(len(f.Value().Bytes())) > end {
+				end = o + uint64(len(f.Value().Bytes()))
+			}
+		}
+		if !tifd.HasField(330) || tif.Version() != 42 {
+			return nil
+		}
+		if depth >= 4 {
+			return fmt.Errorf("too many nested subifds")
+		}
+		//overviews referenced from a SubIFDs tag, and the ifds chained after them
+		subs := struct {
+			Offsets []uint64 `tiff:"field,tag=330"`
+		}{}
+		if err := tiff.UnmarshalIFD(tifd, &subs); err != nil {
+			return err
+		}
+		for _, sub := range subs.Offsets {
+			for n := 0; sub != 0 && n <= 1024; n++ {
+				stifd, err := tiff.ParseIFD(tif.R(), sub, nil, nil)
+				if err != nil {
+					return fmt.Errorf("parse subifd at %d: %w", sub, err)
+				}
+				if err = measure(stifd, sub, depth+1); err != nil {
+					return err
+				}
+				sub = stifd.NextOffset()
+			}
+		}
+		return nil
+	}
+	off := tif.FirstOffset()
+	for _, tifd := range tif.IFDs() {
+		if err = measure(tifd, off, 0); err != nil {
+			return 0, err
+		}
+		off = tifd.NextOffset()
+	}
+	return int64(end), nil
+}
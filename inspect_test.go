@@ -0,0 +1,87 @@
+package cogger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	f, err := os.Open("testdata/cog_graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := bytes.Buffer{}
+	if err := Inspect(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"byteorder: little\n",
+		"format: classic\n",
+		"ghost: yes\n",
+		"ghost.MASK_INTERLEAVED_WITH_IMAGERY=YES\n",
+		"ifd 3: size=128x128 subfiletype=5 compression=DEFLATE tilesize=128x128 tiles=1 first_offset=1591 last_offset=1591\n",
+		"decimation: 2.00\n",
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(line)) {
+			t.Errorf("missing %q", line)
+		}
+	}
+}
+
+func TestInspectInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		tag     uint16
+		value   uint32
+		invalid string
+	}{
+		{"tile size", 322, 8, "invalid tile size 8x16"},
+		{"tile count", 257, 32, "16x32 image with 16x16 tiles and 1 planes: expecting 2 tiles"},
+	} {
+		data := encodeTIFF(t, withTiles(grayIFD(16, 16, 16), []byte{1}))
+		setTag(t, data, tc.tag, tc.value)
+		if err := Rewrite(io.Discard, bytes.NewReader(data)); err == nil {
+			t.Errorf("%s: invalid file not rejected by Rewrite", tc.name)
+		}
+		buf := bytes.Buffer{}
+		if err := Inspect(&buf, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		for _, line := range []string{"ifd 0: size=", "ifd 0: invalid: " + tc.invalid} {
+			if !bytes.Contains(buf.Bytes(), []byte(line)) {
+				t.Errorf("%s: missing %q in %s", tc.name, line, buf.String())
+			}
+		}
+	}
+}
+
+func TestInspectSubIFDs(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.OverviewLayout = SubIFD
+	cog := bytes.Buffer{}
+	if err := cfg.Rewrite(&cog, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	if err := Inspect(&buf, bytes.NewReader(cog.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	//the overview and its mask are only referenced from the SubIFDs tag
+	for _, line := range []string{
+		"ifd 1: size=128x128 subfiletype=1 ",
+		"ifd 2: size=128x128 subfiletype=5 ",
+		"ifd 3: size=256x256 subfiletype=4 ",
+		"decimation: 2.00\n",
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(line)) {
+			t.Errorf("missing %q", line)
+		}
+	}
+}
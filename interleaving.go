@@ -0,0 +1,136 @@
+package cogger
+
+import "fmt"
+
+// DataOrder is the order in which the tile data of the overview levels is written
+type DataOrder int
+
+const (
+	// OverviewsFirst writes the smallest overview first and the full resolution
+	// image last, as recommended for COGs
+	OverviewsFirst DataOrder = iota
+	// FullResFirst writes the full resolution image first and the smallest
+	// overview last. This breaks the COG layout, and the ghost area advertises
+	// KNOWN_INCOMPATIBLE_EDITION=YES
+	FullResFirst
+)
+
+// OverviewLayout is the way overview ifds are referenced from the full
+// resolution ifd
+type OverviewLayout int
+
+const (
+	// ChainedIFD chains the overview ifds after the full resolution ones
+	ChainedIFD OverviewLayout = iota
+	// SubIFD references each overview level from a SubIFDs (330) tag of the full
+	// resolution ifd. The masks of each level are chained after it
+	SubIFD
+)
+
+// PlanarInterleaving describes the order in which the tiles of a given
+// overview level are written. Each entry is a group of planes whose tiles are
+// interleaved at each tile position; groups are written one after the other.
+//
+// Plane indexes 0 to nplanes-1 refer to the planes of the image (nplanes is
+// SamplesPerPixel for PlanarConfiguration=2 images, 1 otherwise), and index
+// nplanes+i refers to its i-th mask. Each plane must appear exactly once.
+// Levels may have different numbers of masks (e.g. masks on the overviews
+// only): masks are numbered after the level that has the most, and the ones
+// a level lacks are skipped.
+//
+// A nil PlanarInterleaving writes the tiles of each level in the order of their
+// TileOffsets array, each followed by the tile of its masks. For chunky images
+// this interleaves the image and mask tiles at each tile position. The tiles
+// of PlanarConfiguration=2 images are however stored plane after plane, so that
+// they are written band major, with the mask tiles inserted after each group of
+// nplanes tiles. This is the historical layout, which is kept byte-identical
+// and advertises the mask as interleaved in all cases.
+type PlanarInterleaving [][]int
+
+// PixelInterleaving writes the tiles of all planes (followed by the mask tile
+// if hasMask) next to each other for each tile position. This is optimal for
+// reading all the bands of a region.
+func PixelInterleaving(nplanes int, hasMask bool) PlanarInterleaving {
+	group := []int{}
+	for i := 0; i < nplanes; i++ {
+		group = append(group, i)
+	}
+	if hasMask {
+		group = append(group, nplanes)
+	}
+	return PlanarInterleaving{group}
+}
+
+// BandMajorInterleaving writes all the tiles of a plane before the tiles of the
+// next one, so that reading a few bands of a large area results in contiguous
+// reads. The mask tiles, if any, are written last.
+func BandMajorInterleaving(nplanes int, hasMask bool) PlanarInterleaving {
+	pi := PlanarInterleaving{}
+	for i := 0; i < nplanes; i++ {
+		pi = append(pi, []int{i})
+	}
+	if hasMask {
+		pi = append(pi, []int{nplanes})
+	}
+	return pi
+}
+
+// MaskSeparateInterleaving interleaves the tiles of all planes, and writes all
+// the mask tiles after them.
+func MaskSeparateInterleaving(nplanes int) PlanarInterleaving {
+	pi := PixelInterleaving(nplanes, false)
+	return append(pi, []int{nplanes})
+}
+
+// maskInterleaved returns true if the tiles of the first mask are written
+// along with the ones of the first plane
+func (pi PlanarInterleaving) maskInterleaved(nplanes int) bool {
+	if pi == nil {
+		return true
+	}
+	for _, group := range pi {
+		hasImage, hasMask := false, false
+		for _, p := range group {
+			hasImage = hasImage || p == 0
+			hasMask = hasMask || p == nplanes
+		}
+		if hasImage {
+			return hasMask
+		}
+	}
+	return false
+}
+
+// validate checks that pi references each of the nplanes planes and nmasks
+// masks exactly once
+func (pi PlanarInterleaving) validate(nplanes, nmasks int) error {
+	seen := make([]bool, nplanes+nmasks)
+	for _, group := range pi {
+		if len(group) == 0 {
+			return fmt.Errorf("planar interleaving %v has an empty group", pi)
+		}
+		for _, p := range group {
+			if p < 0 || p >= len(seen) {
+				return fmt.Errorf("planar interleaving %v: invalid plane %d for %d planes and %d masks", pi, p, nplanes, nmasks)
+			}
+			if seen[p] {
+				return fmt.Errorf("planar interleaving %v: plane %d referenced more than once", pi, p)
+			}
+			seen[p] = true
+		}
+	}
+	for p, ok := range seen {
+		if !ok {
+			return fmt.Errorf("planar interleaving %v: missing plane %d", pi, p)
+		}
+	}
+	return nil
+}
+
+// planeCount returns the number of planes of the ifd's tiles
+func (ifd *ifd) planeCount() int {
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
+		return int(ifd.SamplesPerPixel)
+	}
+	return 1
+}
@@ -0,0 +1,175 @@
+package cogger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/google/tiff"
+)
+
+func TestPlanarInterleaving(t *testing.T) {
+	rgb := grayIFD(512, 256, 256)
+	rgb.SamplesPerPixel = 3
+	rgb.BitsPerSample = []uint16{8, 8, 8}
+	rgb.SampleFormat = []uint16{1, 1, 1}
+	rgb.PhotometricInterpretation = photometricInterpretationRGB
+	rgb.PlanarConfiguration = planarConfigurationSeparate
+	withTiles(rgb, []byte("r0"), []byte("r1"), []byte("g0"), []byte("g1"), []byte("b0"), []byte("b1"))
+	msk := grayIFD(512, 256, 256)
+	msk.BitsPerSample = []uint16{1}
+	msk.PhotometricInterpretation = photometricInterpretationMask
+	withTiles(msk, []byte("m0"), []byte("m1"))
+	if err := rgb.AddMask(msk); err != nil {
+		t.Fatal(err)
+	}
+	src := encodeTIFF(t, rgb)
+
+	for _, tc := range []struct {
+		pi          PlanarInterleaving
+		order       string
+		interleaved bool
+	}{
+		//default: tiles in TileOffsets order, in groups of nplanes followed by a mask tile
+		{nil, "r0r1g0m0g1b0b1m1", true},
+		{PixelInterleaving(3, true), "r0g0b0m0r1g1b1m1", true},
+		{BandMajorInterleaving(3, true), "r0r1g0g1b0b1m0m1", false},
+		{MaskSeparateInterleaving(3), "r0g0b0r1g1b1m0m1", false},
+		{PlanarInterleaving{{3, 0}, {2, 1}}, "m0r0m1r1b0g0b1g1", true},
+	} {
+		cfg := DefaultConfig()
+		cfg.PlanarInterleaving = tc.pi
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatalf("%v: %v", tc.pi, err)
+		}
+		data := buf.Bytes()
+		ifds := parseIFDs(t, data)
+		offsets := append(ifds[0].OriginalTileOffsets, ifds[1].OriginalTileOffsets...)
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		order := ""
+		for _, off := range offsets {
+			order += string(data[off : off+2])
+		}
+		if order != tc.order {
+			t.Errorf("%v: got tile order %s, expected %s", tc.pi, order, tc.order)
+		}
+		if got := bytes.Contains(data[:ifds[0].OriginalTileOffsets[0]], []byte("MASK_INTERLEAVED_WITH_IMAGERY=YES")); got != tc.interleaved {
+			t.Errorf("%v: mask interleaved=%v", tc.pi, got)
+		}
+		eq, diff, err := TilesEqual(bytes.NewReader(src), bytes.NewReader(data))
+		if err != nil || !eq {
+			t.Errorf("%v: %v %s", tc.pi, err, diff)
+		}
+	}
+
+	for _, pi := range []PlanarInterleaving{
+		BandMajorInterleaving(3, false),
+		{{0, 1, 2, 3}, {1}},
+		{{0, 1, 2, 4}},
+		{{0, 1}, {}, {2, 3}},
+	} {
+		cfg := DefaultConfig()
+		cfg.PlanarInterleaving = pi
+		if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+			t.Errorf("%v: expected an error", pi)
+		}
+	}
+}
+
+func TestDataOrder(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, order := range []DataOrder{OverviewsFirst, FullResFirst} {
+		cfg := DefaultConfig()
+		cfg.DataOrder = order
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		incompatible := bytes.Contains(buf.Bytes(), []byte("KNOWN_INCOMPATIBLE_EDITION=YES\n"))
+		if incompatible != (order == FullResFirst) {
+			t.Errorf("order %d: ghost area has KNOWN_INCOMPATIBLE_EDITION=YES: %v", order, incompatible)
+		}
+		ifds := parseIFDs(t, buf.Bytes())
+		//ranges of tile offsets of each level, images and masks included
+		type span struct{ min, max uint64 }
+		levels := []span{}
+		for _, ifd := range ifds {
+			if ifd.SubfileType&subfileTypeMask == 0 {
+				levels = append(levels, span{^uint64(0), 0})
+			}
+			cur := &levels[len(levels)-1]
+			for i, off := range ifd.OriginalTileOffsets {
+				if ifd.TileByteCounts[i] == 0 {
+					continue
+				}
+				if off < cur.min {
+					cur.min = off
+				}
+				if off > cur.max {
+					cur.max = off
+				}
+			}
+		}
+		for i := 1; i < len(levels); i++ {
+			prev, cur := levels[i-1], levels[i]
+			if order == FullResFirst && prev.max > cur.min || order == OverviewsFirst && cur.max > prev.min {
+				t.Errorf("order %d: level %d data %v not in order with level %d %v", order, i, cur, i-1, prev)
+			}
+		}
+		eq, diff, err := TilesEqual(bytes.NewReader(src), bytes.NewReader(buf.Bytes()))
+		if err != nil || !eq {
+			t.Errorf("order %d: %v %s", order, err, diff)
+		}
+	}
+}
+
+func TestSubIFDLayout(t *testing.T) {
+	for _, name := range []string{"graymask.tif", "exttest.tif"} {
+		src, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref := bytes.Buffer{}
+		if err := Rewrite(&ref, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		cfg := DefaultConfig()
+		cfg.OverviewLayout = SubIFD
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		tif, err := tiff.Parse(bytes.NewReader(buf.Bytes()), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refIFDs := parseIFDs(t, ref.Bytes())
+		nlevels := 0
+		for _, ifd := range refIFDs {
+			if ifd.SubfileType&subfileTypeMask == 0 {
+				nlevels++
+			}
+		}
+		top := tif.IFDs()
+		if len(top) != len(refIFDs)/nlevels {
+			t.Errorf("%s: got %d chained ifds", name, len(top))
+		}
+		if nlevels > 1 && (!top[0].HasField(330) || top[0].GetField(330).Count() != uint64(nlevels-1)) {
+			t.Errorf("%s: missing SubIFDs tag", name)
+		}
+		//reading the subifds back gives back the chained layout
+		back := bytes.Buffer{}
+		if err := Rewrite(&back, bytes.NewReader(buf.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(back.Bytes(), ref.Bytes()) {
+			t.Errorf("%s: rewriting the subifd layout differs from the chained layout", name)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package cogger
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/tiff"
+)
+
+// TileRef locates a tile of the output COG
+type TileRef struct {
+	// Level is the overview level of the tile, 0 being the full resolution image
+	Level int
+	// Mask is the index of the mask the tile belongs to, or -1 for image tiles
+	Mask int
+	// Plane is the plane of the tile, always 0 for PlanarConfiguration=1 images
+	Plane int
+	// X and Y are the column and row of the tile
+	X, Y int
+	// Offset is the output offset of the tile data. When the ghost area block
+	// leader is enabled, the 4 byte tile size must be written just before it,
+	// and when the block trailer is enabled the last 4 bytes of the tile data
+	// must be repeated just after it.
+	Offset uint64
+	// Size is the number of bytes of tile data
+	Size uint64
+	// Duplicate is set when the tile shares the data of a previously yielded
+	// tile (see Config.DedupeTiles), in which case nothing has to be written
+	Duplicate bool
+
+	cog  *cog
+	tile tile
+}
+
+// ReadData reads the tile data into buf, which must be at least Size bytes long.
+// The data is the one Rewrite would write: tiles that cannot be read are
+// handled by Config.OnTileError, and are replaced by zeros unless it aborts.
+func (t TileRef) ReadData(buf []byte) error {
+	if uint64(len(buf)) < t.Size {
+		return fmt.Errorf("buffer of %d bytes too small for tile of %d bytes", len(buf), t.Size)
+	}
+	return t.cog.readTile(t.tile, buf[:t.Size])
+}
+
+// TileSequence yields the tiles of a COG in the order in which their data must
+// be written. Iteration stops when yield returns false. Its signature matches
+// iter.Seq[TileRef], so that it can be ranged over with go1.23 and later.
+type TileSequence func(yield func(TileRef) bool)
+
+// Layout writes the header and ifds of the COG that would be created from
+// readers to header, and returns the sequence of tiles whose data must follow.
+// This allows driving the writing of the tile data to a custom sink. Sparse
+// tiles, including the ones made sparse by Config.OnTileError, are not yielded.
+func (cfg Config) Layout(header io.Writer, readers ...tiff.ReadAtReadSeeker) (TileSequence, error) {
+	tiffs, err := parseReaders(readers)
+	if err != nil {
+		return nil, err
+	}
+	cog, err := cfg.newCOG(tiffs)
+	if err != nil {
+		return nil, err
+	}
+	if err = cog.computeImageryOffsets(); err != nil {
+		return nil, err
+	}
+	if err = cog.writeIFDs(header); err != nil {
+		return nil, err
+	}
+	return cog.tileSequence(), nil
+}
+
+// tileSequence returns the tiles of cog, once their offsets have been computed
+func (cog *cog) tileSequence() TileSequence {
+	type position struct{ level, mask int }
+	positions := map[*ifd]position{}
+	level := 0
+	for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+		positions[ifd] = position{level, -1}
+		for i, msk := range ifd.masks {
+			positions[msk] = position{level, i}
+		}
+		level++
+	}
+	return func(yield func(TileRef) bool) {
+		tiles := cog.dataInterlacing().tiles(cog.cfg.PlanarInterleaving)
+		for tile := range tiles {
+			idx := tile.idx
+			size := uint64(tile.ifd.TileByteCounts[idx])
+			if size == 0 {
+				continue
+			}
+			offset := uint64(0)
+			if cog.bigtiff {
+				offset = tile.ifd.NewTileOffsets64[idx]
+			} else {
+				offset = uint64(tile.ifd.NewTileOffsets32[idx])
+			}
+			pos := positions[tile.ifd]
+			ref := TileRef{
+				Level:     pos.level,
+				Mask:      pos.mask,
+				Plane:     int(tile.plane),
+				X:         int(tile.x),
+				Y:         int(tile.y),
+				Offset:    offset,
+				Size:      size,
+				Duplicate: tile.ifd.duplicates[idx],
+				cog:       cog,
+				tile:      tile,
+			}
+			if !yield(ref) {
+				for range tiles {
+					//skip
+				}
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package cogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	src, err := os.ReadFile("testdata/band4mask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := bytes.Buffer{}
+	if err := Rewrite(&ref, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+
+	header := bytes.Buffer{}
+	seq, err := DefaultConfig().Layout(&header, bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make([]byte, header.Len(), ref.Len())
+	copy(out, header.Bytes())
+	masks := 0
+	seq(func(tile TileRef) bool {
+		if tile.Mask >= 0 {
+			masks++
+		}
+		if tile.Duplicate {
+			return true
+		}
+		if tile.Offset != uint64(len(out))+4 {
+			t.Fatalf("tile %+v: unexpected offset, expected %d", tile, len(out)+4)
+		}
+		data := make([]byte, tile.Size)
+		if err := tile.ReadData(data); err != nil {
+			t.Fatal(err)
+		}
+		leader := make([]byte, 4)
+		binary.LittleEndian.PutUint32(leader, uint32(tile.Size))
+		out = append(out, leader...)
+		out = append(out, data...)
+		out = append(out, data[len(data)-4:]...)
+		return true
+	})
+	if masks == 0 {
+		t.Error("no mask tile yielded")
+	}
+	if !bytes.Equal(out, ref.Bytes()) {
+		t.Error("layout output differs from Rewrite")
+	}
+
+	count := 0
+	seq(func(tile TileRef) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Errorf("iteration did not stop, got %d tiles", count)
+	}
+}
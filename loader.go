@@ -1,9 +1,15 @@
 package cogger
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash"
 	"io"
+	"math"
 	"sort"
+	"strings"
 
 	"github.com/google/tiff"
 )
@@ -11,12 +17,13 @@ import (
 func loadMultipleTIFFs(tifs []tiff.TIFF) ([]*ifd, error) {
 	ifds := make([]*ifd, 0)
 	for it, tif := range tifs {
-		tifds := tif.IFDs()
-		for i := range tifds {
-			ifd, err := loadIFD(tif.R(), tifds[i])
-			if err != nil {
-				return nil, err
-			}
+		tifds, err := loadTIFF(tif)
+		if err != nil {
+			return nil, err
+		}
+		for _, ifd := range tifds {
+			ifd.src = it
+			ifd.input = len(ifds)
 			if it != 0 {
 				//check that the additional files are smaller than the first, i.e. that they represent an overview
 				if ifd.ImageLength >= ifds[0].ImageLength || ifd.ImageWidth >= ifds[0].ImageWidth {
@@ -33,12 +40,63 @@ func loadMultipleTIFFs(tifs []tiff.TIFF) ([]*ifd, error) {
 }
 
 func loadSingleTIFF(tif tiff.TIFF) ([]*ifd, error) {
-	tifds := tif.IFDs()
-	ifds := make([]*ifd, len(tifds))
-	var err error
-	for i := range tifds {
-		ifds[i], err = loadIFD(tif.R(), tifds[i])
+	ifds, err := loadTIFF(tif)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifds {
+		ifds[i].input = i
+	}
+	return ifds, nil
+}
+
+// loadTIFF loads all the ifds of tif. The ifds referenced by a SubIFDs tag, and
+// the ifds chained after them, follow their parent ifd.
+func loadTIFF(tif tiff.TIFF) ([]*ifd, error) {
+	return walkTIFF(tif, loadIFD)
+}
+
+// walkTIFF loads all the ifds of tif with loadIFD, in the order of loadTIFF
+func walkTIFF(tif tiff.TIFF, loadIFD func(tiff.BReader, tiff.IFD) (*ifd, error)) ([]*ifd, error) {
+	ifds := []*ifd{}
+	var load func(tifd tiff.IFD, depth int) error
+	load = func(tifd tiff.IFD, depth int) error {
+		ifd, err := loadIFD(tif.R(), tifd)
 		if err != nil {
+			return err
+		}
+		ifds = append(ifds, ifd)
+		subs := ifd.SubIFDs
+		ifd.SubIFDs = nil //rewritten according to Config.OverviewLayout
+		if len(subs) == 0 {
+			return nil
+		}
+		if tif.Version() != 42 {
+			return fmt.Errorf("subifds are only supported in classic tiffs")
+		}
+		if depth >= 4 {
+			return fmt.Errorf("too many nested subifds")
+		}
+		for _, off := range subs {
+			//each subifd may be followed by a chain of ifds
+			for n := 0; off != 0; n++ {
+				if n > 1024 {
+					return fmt.Errorf("subifd chain too long")
+				}
+				sub, err := tiff.ParseIFD(tif.R(), off, nil, nil)
+				if err != nil {
+					return fmt.Errorf("parse subifd at %d: %w", off, err)
+				}
+				if err = load(sub, depth+1); err != nil {
+					return err
+				}
+				off = sub.NextOffset()
+			}
+		}
+		return nil
+	}
+	for _, tifd := range tif.IFDs() {
+		if err := load(tifd, 0); err != nil {
 			return nil, err
 		}
 	}
@@ -46,6 +104,18 @@ func loadSingleTIFF(tif tiff.TIFF) ([]*ifd, error) {
 }
 
 func loadIFD(r tiff.BReader, tifd tiff.IFD) (*ifd, error) {
+	ifd, err := unmarshalIFD(r, tifd)
+	if err != nil {
+		return nil, err
+	}
+	if err = ifd.validate(); err != nil {
+		return nil, err
+	}
+	return ifd, nil
+}
+
+// unmarshalIFD decodes the tags of tifd, without checking their consistency
+func unmarshalIFD(r tiff.BReader, tifd tiff.IFD) (*ifd, error) {
 	ifd := &ifd{r: r}
 	err := tiff.UnmarshalIFD(tifd, ifd)
 	if err != nil {
@@ -61,81 +131,839 @@ func loadIFD(r tiff.BReader, tifd tiff.IFD) (*ifd, error) {
 	return ifd, nil
 }
 
+// validate returns an error if the tiling or colormap of ifd are inconsistent
+func (ifd *ifd) validate() error {
+	if ifd.TileWidth == 0 || ifd.TileWidth%16 != 0 || ifd.TileLength == 0 || ifd.TileLength%16 != 0 {
+		return fmt.Errorf("invalid tile size %dx%d: must be a multiple of 16", ifd.TileWidth, ifd.TileLength)
+	}
+	if ifd.PhotometricInterpretation == photometricInterpretationPalette {
+		bits := uint16(1)
+		if len(ifd.BitsPerSample) > 0 {
+			bits = ifd.BitsPerSample[0]
+		}
+		if bits > 16 {
+			return fmt.Errorf("invalid palette image with %d bits per sample", bits)
+		}
+		if len(ifd.Colormap) != 3<<bits {
+			return fmt.Errorf("invalid colormap of %d entries for a %d bit palette image: expecting %d",
+				len(ifd.Colormap), bits, 3<<bits)
+		}
+	}
+	ntilesx := (ifd.ImageWidth + uint64(ifd.TileWidth) - 1) / uint64(ifd.TileWidth)
+	ntilesy := (ifd.ImageLength + uint64(ifd.TileLength) - 1) / uint64(ifd.TileLength)
+	ntiles := ntilesx * ntilesy * uint64(ifd.planeCount())
+	if uint64(len(ifd.OriginalTileOffsets)) != ntiles || uint64(len(ifd.TileByteCounts)) != ntiles {
+		return fmt.Errorf("%dx%d image with %dx%d tiles and %d planes: expecting %d tiles, got %d offsets and %d byte counts",
+			ifd.ImageWidth, ifd.ImageLength, ifd.TileWidth, ifd.TileLength, ifd.planeCount(), ntiles,
+			len(ifd.OriginalTileOffsets), len(ifd.TileByteCounts))
+	}
+	return nil
+}
+
+// Config holds the options used when rewriting tiffs to COGs
+type Config struct {
+	// DedupeTiles makes tiles with identical content point to a single copy of
+	// their data. This shrinks files with large constant or nodata regions, at the
+	// cost of an additional read of every tile, and breaks the strictly increasing
+	// tile offsets expected from a COG: the output is therefore flagged with
+	// KNOWN_INCOMPATIBLE_EDITION=YES
+	DedupeTiles bool
+
+	// TileCache, if set, is consulted before reading tile data from the source
+	// readers. Without a cache, tiles that are accessed more than once (e.g. when
+	// deduplicating) are read again from the source each time
+	TileCache TileCache
+
+	// MarkIncompatibleEdition sets KNOWN_INCOMPATIBLE_EDITION=YES in the ghost
+	// area, for files that will be modified in a way that breaks the COG layout
+	// once written. gdal then requires IGNORE_COG_LAYOUT_BREAK to open them. This
+	// is implied by DedupeTiles
+	MarkIncompatibleEdition bool
+
+	// DisableGhostBlockLeader stops prefixing the data of each tile with its size,
+	// as a 4 byte integer, and advertising it with the BLOCK_LEADER=SIZE_AS_UINT4
+	// ghost area entry
+	DisableGhostBlockLeader bool
+
+	// DisableGhostBlockTrailer stops repeating the last 4 bytes of each tile after
+	// its data, and advertising it with the BLOCK_TRAILER=LAST_4_BYTES_REPEATED
+	// ghost area entry. When enabled, tiles smaller than 4 bytes are repeated after
+	// as many leading zeros
+	DisableGhostBlockTrailer bool
+
+	// OnTileError, if set, is called when the data of a tile cannot be read, and
+	// returns whether to abort the rewrite, to write the tile as sparse or to
+	// write zeros in its place, e.g. to salvage a partially corrupt input. level
+	// is the overview level (0 being the full resolution), and masks are numbered
+	// after the image planes, as in PlanarInterleaving.
+	//
+	// As the tile offsets are written before the tile data, a tile can only be
+	// made sparse if its read fails before they are computed. Setting OnTileError
+	// therefore reads every tile once beforehand (and again when it is written,
+	// unless a TileCache holds it), and OnTileError is called once per unreadable
+	// tile, whose status is kept for the rest of the rewrite. A tile whose read
+	// only fails when it is written is replaced by zeros of the same size, even if
+	// SkipAsSparse is returned.
+	OnTileError func(level, plane, x, y int, err error) TileErrorAction
+
+	// MaxTileBytes is the maximum accepted size of a single tile, in order to fail
+	// early on corrupted inputs instead of attempting huge allocations. No limit
+	// is enforced if 0
+	MaxTileBytes int
+
+	// MaxTileBufferReuse, if positive, caps the size of the buffer that is kept
+	// between tiles when writing the tile data: a buffer grown for a larger tile
+	// is released once a tile fits under the cap. This trades allocations for
+	// memory when tile sizes vary widely
+	MaxTileBufferReuse int
+
+	// VerifyOffsets checks, once the tile offsets have been computed and before
+	// any data is written, that the tiles are laid out in increasing order in the
+	// order they are written, and that no two tiles overlap (including their
+	// ghost block leader and trailer). This guards against bugs in the offset
+	// computations at the cost of an extra pass over the tiles
+	VerifyOffsets bool
+
+	// VerifyLayout checks, once the header (i.e. the tiff header, ghost area, ifds
+	// and strile data) has been written, that its size matches the offset of the
+	// first tile, so that a bug in the header size computations is reported as an
+	// error instead of producing a corrupted file
+	VerifyLayout bool
+
+	// MaxStrileDataBytes, if positive, bounds the memory used to hold the
+	// TileOffsets and TileByteCounts arrays of all ifds before they are written:
+	// past this size they are buffered in a temporary file instead. This matters
+	// for COGs with millions of tiles, and does not change the output
+	MaxStrileDataBytes int
+
+	// StrictPyramid makes the rewrite fail if the decimation factors between
+	// consecutive levels are not all the same, which usually means that an
+	// overview level is missing. Factors are compared once rounded, so that
+	// overviews of odd sized levels may be rounded up or down (e.g. 8000 or 8001
+	// for 16001)
+	StrictPyramid bool
+
+	// OnPyramidWarning, if set, is called with a description of the problem when
+	// the rounded decimation factors between consecutive levels are not all the
+	// same (unless StrictPyramid fails the rewrite instead), or are not powers of
+	// two. See also DecimationFactors
+	OnPyramidWarning func(warning string)
+
+	// OnIFDRole, if set, is called for each input ifd that is written with the
+	// role it has been assigned: "fullres", "mask" or "overview", and its overview
+	// level (0 being the full resolution). Ifds that are dropped (e.g. by
+	// MinKeptOverviewSize) are not reported. idx is the index of the ifd among all
+	// the input ifds, in the order of the readers. This helps debugging inputs
+	// that are not assembled as expected
+	OnIFDRole func(idx, level int, role string)
+
+	// MetadataRewriter, if set, is called for each ifd with the content of its
+	// GDAL_METADATA (42112) tag, and returns the content to write instead. Level 0
+	// is the full resolution image, and mask is set for mask ifds. Returning an
+	// empty string removes the tag
+	MetadataRewriter func(level int, mask bool, xml string) (string, error)
+
+	// AuxXML, if set, is the content of a gdal PAM (.aux.xml) sidecar of the input,
+	// whose metadata and band statistics are merged into the GDAL_METADATA of the
+	// full resolution image (see MergeAuxXML). Its nodata value is also written to
+	// the GDAL_NODATA tag, unless the input already has one. This is applied before
+	// MetadataRewriter
+	AuxXML []byte
+
+	// NoData, if set, replaces the GDAL_NODATA (42113) tag of the image ifds of
+	// all levels. The value is written as gdal does, i.e. without surrounding
+	// spaces, and an empty value removes the tag. Without it, the tag is copied
+	// as is, including any trailing space of the input
+	NoData *string
+
+	// BandOrder, if set, rearranges the bands of the image and overview ifds so that
+	// band i of the output is band BandOrder[i] of the input (e.g. []int{2,1,0} to
+	// convert RGB to BGR). This is cheap for planar (PlanarConfiguration=2) data, but
+	// chunky tiles must be decoded and compressed again, which is only supported
+	// for uncompressed, LZW and DEFLATE tiles, and requires holding the transcoded
+	// tiles in memory. Extra samples (e.g. alpha) must not be moved. The band
+	// items of the GDAL metadata (e.g. statistics) are renumbered accordingly
+	BandOrder []int
+
+	// NoBigTIFFPromotion makes the rewrite fail when the output does not fit in a
+	// classic tiff, instead of silently producing a bigtiff
+	NoBigTIFFPromotion bool
+
+	// DefaultSampleFormat, if non zero, is written as the SampleFormat of the image
+	// and overviews when the source omits the tag, e.g. 2 for signed data that
+	// would otherwise be interpreted as unsigned. Masks are left untouched
+	DefaultSampleFormat uint16
+
+	// MaskFromAlpha adds an internal 8 bit mask derived from the alpha band to
+	// each level that has an alpha band and no mask. Alpha tiles must be decoded,
+	// which requires uncompressed, LZW or deflate tiles, and the mask tiles are
+	// kept in memory
+	MaskFromAlpha bool
+
+	// Photometric, if set, replaces the PhotometricInterpretation of the image and
+	// overview ifds (but not of masks), e.g. to fix sources labelled MinIsWhite
+	// instead of MinIsBlack. Tiles are not modified, so the new value must
+	// describe the existing data. The number of bands is checked against the new
+	// value
+	Photometric *uint16
+
+	// CRS, if set, replaces the coordinate reference system of the main image
+	CRS *CRS
+
+	// KeepGCPsOnOverviews propagates ModelTiePointTag arrays holding multiple tie
+	// points (GCPs) of the main image to its overviews, with their raster
+	// coordinates scaled to the overview's resolution. By default they are
+	// cleared along with the other georeferencing tags
+	KeepGCPsOnOverviews bool
+
+	// StrictJPEG makes the rewrite fail if a jpeg compressed ifd has no JPEGTables
+	// tag and its tiles do not carry their own tables, in which case they cannot
+	// be decoded. Only the first non-empty tile of each ifd is checked
+	StrictJPEG bool
+
+	// InlineJPEGTables copies the JPEGTables of jpeg compressed ifds into each of
+	// their tiles and removes the tag, so that tiles can be served as standalone
+	// jpeg files. This grows each tile by the size of the tables, and the tiles
+	// are kept in memory
+	InlineJPEGTables bool
+
+	// RequiredTileSize, if set, is the width and length that the tiles of every
+	// input ifd must have. cogger otherwise keeps the tiling of each input ifd,
+	// which may differ between levels (see Retile to change it)
+	RequiredTileSize [2]int
+
+	// UniformTileSize makes the rewrite fail if the input ifds do not all have the
+	// tile size of the full resolution image, e.g. to catch overviews computed
+	// in separate files with other options
+	UniformTileSize bool
+
+	// OverviewScaler, if set, converts the 16 bit unsigned samples of the overviews
+	// (but not of the full resolution image) to 8 bit ones, e.g. to serve 8 bit
+	// visualization overviews along with 16 bit data. It is called for each
+	// sample with its band, and the overview tiles are decoded, which requires
+	// uncompressed, LZW or DEFLATE tiles without predictor, and kept in memory.
+	// Note that gdal expects all the levels of a dataset to share the same data
+	// type: the output is a non-standard COG whose overviews gdal may ignore, and
+	// that must be read with dedicated code
+	OverviewScaler func(band int, v uint16) uint8
+
+	// Retile, if set, is the width and length of the output tiles of all the
+	// image, overview and mask ifds, e.g. {512, 512} to merge 256x256 input tiles.
+	// Tiles are decoded and assembled again, which requires uncompressed, LZW or
+	// DEFLATE tiles and no predictor. Bit packed samples such as 1 bit gdal masks
+	// are supported. The new tiles are kept in memory
+	Retile [2]int
+
+	// ForcePlanarConfig, if non zero, is the PlanarConfiguration of the output
+	// image and overviews. Only the conversion of chunky (1) tiles to separate (2)
+	// ones is supported: each tile is decoded and split into one tile per band,
+	// which enables band-major access patterns (see BandMajorInterleaving). This
+	// requires uncompressed, LZW or DEFLATE tiles, and the split tiles are kept in
+	// memory
+	ForcePlanarConfig uint16
+
+	// Transcodings maps the compression of input tiles to the compression they
+	// should be converted to, see Transcode
+	Transcodings map[Compression]Compression
+
+	// MinKeptOverviewSize, if positive, drops the overviews (and their masks)
+	// whose largest dimension is smaller than it. Unlike dropping overviews by
+	// index, this gives consistent pyramids when inputs have different numbers of
+	// overviews
+	MinKeptOverviewSize int
+
+	// OverviewLayout sets how the overview ifds are referenced. Note that ifds
+	// are laid out in the same order whatever the layout
+	OverviewLayout OverviewLayout
+
+	// DataOrder sets the order of the tile data of the levels. The ifds are
+	// always written from the full resolution to the smallest overview
+	DataOrder DataOrder
+
+	// PlanarInterleaving sets the order in which the tiles of the planes and masks
+	// of each level are written. nil keeps the order of the TileOffsets array
+	// (see the PlanarInterleaving type)
+	PlanarInterleaving PlanarInterleaving
+
+	// ShortDimensions writes ImageWidth and ImageLength as SHORT values when they
+	// fit, as libtiff (and hence gdal) does, instead of always using LONG. This
+	// helps producing headers that are byte-identical to gdal's
+	ShortDimensions bool
+
+	// TagOrder, if set, is the order in which ifd entries are written, e.g. to
+	// produce headers that are byte-identical to the ones of a given gdal version.
+	// Tags that are not listed are written after the listed ones, in increasing
+	// order. Note that the tiff spec requires entries to be sorted by increasing
+	// tag, and that the out-of-line tag data is always laid out in increasing tag
+	// order
+	TagOrder []uint16
+
+	// Encoding is the byte order of the output file. Defaults to the byte order
+	// of the full resolution input if nil. Tiles with samples wider than 8 bits
+	// are byte swapped in memory when an input has the other byte order, which is
+	// only supported for uncompressed, LZW and DEFLATE tiles without the floating
+	// point predictor. JPEG, LERC, WEBP and JXL tiles do not depend on the byte
+	// order and are copied as is
+	Encoding binary.ByteOrder
+}
+
+// DefaultConfig returns the Config used by Rewrite
+func DefaultConfig() Config {
+	return Config{
+		MaxTileBytes: 512 * 1024 * 1024,
+	}
+}
+
 // Rewrite reshuffles the tiff bytes provided as readers into a COG output
-// to out
+// to out, using the default configuration
 func Rewrite(out io.Writer, readers ...tiff.ReadAtReadSeeker) error {
+	return DefaultConfig().Rewrite(out, readers...)
+}
+
+// Rewrite reshuffles the tiff bytes provided as readers into a COG output
+// to out
+func (cfg Config) Rewrite(out io.Writer, readers ...tiff.ReadAtReadSeeker) error {
+	tiffs, err := parseReaders(readers)
+	if err != nil {
+		return err
+	}
+	return cfg.RewriteParsed(out, tiffs...)
+}
+
+// RewriteWithHash is the same as Rewrite, and also writes the output to h, e.g. to
+// compute its checksum for upload integrity checks without reading it again
+func (cfg Config) RewriteWithHash(out io.Writer, h hash.Hash, readers ...tiff.ReadAtReadSeeker) error {
+	return cfg.Rewrite(io.MultiWriter(out, h), readers...)
+}
+
+// AssertIdempotent rewrites r to a COG with the default configuration, then
+// rewrites that COG again, and returns an error if the second output differs
+// from the first. Only the first output is kept in memory, the second one is
+// compared through its sha256 checksum as it is written.
+func AssertIdempotent(r tiff.ReadAtReadSeeker) error {
+	first := bytes.Buffer{}
+	h1 := sha256.New()
+	if err := DefaultConfig().RewriteWithHash(&first, h1, r); err != nil {
+		return fmt.Errorf("first rewrite: %w", err)
+	}
+	h2 := sha256.New()
+	if err := Rewrite(h2, bytes.NewReader(first.Bytes())); err != nil {
+		return fmt.Errorf("second rewrite: %w", err)
+	}
+	if s1, s2 := h1.Sum(nil), h2.Sum(nil); !bytes.Equal(s1, s2) {
+		return fmt.Errorf("rewrite is not idempotent: first output has sha256 %x, second %x", s1, s2)
+	}
+	return nil
+}
+
+func parseReaders(readers []tiff.ReadAtReadSeeker) ([]tiff.TIFF, error) {
 	tiffs := []tiff.TIFF{}
 	if len(readers) == 0 {
-		return fmt.Errorf("missing readers")
+		return nil, fmt.Errorf("missing readers")
 	}
 	for i, r := range readers {
 		tif, err := tiff.Parse(r, nil, nil)
 		if err != nil {
-			return fmt.Errorf("parse tiff %d: %w", i, err)
+			return nil, fmt.Errorf("parse tiff %d: %w", i, err)
 		}
 		tiffs = append(tiffs, tif)
 	}
-	err := sanityCheck(tiffs)
+	return tiffs, nil
+}
+
+// RewriteDataThenHeader writes the tile data of the COG to data, and returns
+// the header (i.e. the tiff header, ghost area and ifds) that must precede it.
+// The tile data is laid out as if written at offset len(header) of the output,
+// i.e. the final file is the concatenation of header and of the bytes written
+// to data. This suits uploaders that can only finalize the first part of an
+// object last.
+func (cfg Config) RewriteDataThenHeader(data io.Writer, readers ...tiff.ReadAtReadSeeker) ([]byte, error) {
+	cog, header, err := cfg.header(readers)
+	if err != nil {
+		return nil, err
+	}
+	if err = cog.writeTiles(data); err != nil {
+		return nil, fmt.Errorf("mucog write: %w", err)
+	}
+	return header, nil
+}
+
+// ExtractHeader returns the header (i.e. the tiff header, ghost area, ifds and
+// strile data) of the COG that Rewrite would create from readers, which is the
+// exact prefix of that COG up to its first tile. Tile data is not read, unless
+// cfg requires it to compute the tile offsets (e.g. DedupeTiles). The header is
+// not a valid tiff on its own as its tile offsets point past its end, but can be
+// served to clients that cache it and fetch the tiles from the full COG.
+func (cfg Config) ExtractHeader(readers ...tiff.ReadAtReadSeeker) ([]byte, error) {
+	_, header, err := cfg.header(readers)
+	return header, err
+}
+
+// header builds the COG of readers and returns it along with its header, i.e.
+// the bytes that precede its first tile
+func (cfg Config) header(readers []tiff.ReadAtReadSeeker) (*cog, []byte, error) {
+	tiffs, err := parseReaders(readers)
+	if err != nil {
+		return nil, nil, err
+	}
+	cog, err := cfg.newCOG(tiffs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = cog.computeImageryOffsets(); err != nil {
+		return nil, nil, fmt.Errorf("mucog write: %w", err)
+	}
+	header := bytes.Buffer{}
+	if err = cog.writeIFDs(&header); err != nil {
+		return nil, nil, fmt.Errorf("mucog write: %w", err)
+	}
+	if cfg.VerifyLayout {
+		if err = cog.verifyLayout(uint64(header.Len())); err != nil {
+			return nil, nil, fmt.Errorf("mucog write: %w", err)
+		}
+	}
+	return cog, header.Bytes(), nil
+}
+
+// RewriteParsed is the same as Rewrite, for callers that have already parsed the
+// input files with tiff.Parse. This avoids parsing the tiff headers a second time,
+// which may be costly for inputs with many ifds or living on high latency storage.
+func (cfg Config) RewriteParsed(out io.Writer, tiffs ...tiff.TIFF) error {
+	cog, err := cfg.newCOG(tiffs)
+	if err != nil {
+		return err
+	}
+	err = cog.write(out)
+	if err != nil {
+		return fmt.Errorf("mucog write: %w", err)
+	}
+	return nil
+}
+
+// RewriteHeader writes only the header and ifds of the COG that would be created
+// from r, for tile data that is not rewritten and already lives elsewhere: the tile
+// offsets are set to their location in r shifted by dataBaseOffset. This allows
+// regenerating the metadata of a (possibly huge) file without copying its tiles.
+// The ghost area options of cfg should describe the existing tile data, and an
+// error is returned if cfg requires modifying it, or if the header would overlap
+// the tile data, i.e. if it does not fit before the first tile.
+func (cfg Config) RewriteHeader(out io.Writer, dataBaseOffset uint64, r tiff.ReadAtReadSeeker) error {
+	tif, err := tiff.Parse(r, nil, nil)
+	if err != nil {
+		return fmt.Errorf("parse tiff: %w", err)
+	}
+	cog, err := cfg.newCOG([]tiff.TIFF{tif})
+	if err != nil {
+		return err
+	}
+	for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+		for _, cur := range append([]*ifd{lvl}, lvl.masks...) {
+			if cur.inMemory {
+				//the existing tile data would not match the header
+				return fmt.Errorf("ifd %dx%d: the tile data is modified by the configuration (e.g. byte order, retiling or transcoding)",
+					cur.ImageWidth, cur.ImageLength)
+			}
+		}
+	}
+	if err = cog.computeExistingOffsets(dataBaseOffset); err != nil {
+		return err
+	}
+	err = cog.writeIFDs(out)
+	if err != nil {
+		return fmt.Errorf("mucog write: %w", err)
+	}
+	return nil
+}
+
+// RewritePages writes each page of the multi-page tiff r as a distinct COG to the
+// writer returned by out. Pages start at each ifd that is neither an overview
+// nor a mask, and include the overviews and masks that follow it. page is the
+// first PageNumber (297) value of the page's ifd if set, or its index otherwise.
+// The page bit of SubfileType and the PageNumber tag are removed.
+func (cfg Config) RewritePages(out func(page int) io.Writer, r tiff.ReadAtReadSeeker) error {
+	tif, err := tiff.Parse(r, nil, nil)
 	if err != nil {
+		return fmt.Errorf("parse tiff: %w", err)
+	}
+	if err = sanityCheck([]tiff.TIFF{tif}); err != nil {
 		return fmt.Errorf("consistency check: %w", err)
 	}
+	ifds, err := loadSingleTIFF(tif)
+	if err != nil {
+		return fmt.Errorf("load: %w", err)
+	}
+	pages := [][]*ifd{}
+	numbers := []int{}
+	for _, ifd := range ifds {
+		if ifd.SubfileType&(subfileTypeReducedImage|subfileTypeMask) == 0 || len(pages) == 0 {
+			number := len(pages)
+			if len(ifd.PageNumber) > 0 {
+				number = int(ifd.PageNumber[0])
+			}
+			pages = append(pages, nil)
+			numbers = append(numbers, number)
+		}
+		ifd.SubfileType &^= subfileTypePage
+		ifd.PageNumber = nil
+		pages[len(pages)-1] = append(pages[len(pages)-1], ifd)
+	}
+	for i, page := range pages {
+		cog, err := cfg.assemble(page)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", numbers[i], err)
+		}
+		if err = cog.write(out(numbers[i])); err != nil {
+			return fmt.Errorf("page %d: mucog write: %w", numbers[i], err)
+		}
+	}
+	return nil
+}
+
+// newCOG loads the ifds of tiffs and arranges them as a COG ifd tree
+func (cfg Config) newCOG(tiffs []tiff.TIFF) (*cog, error) {
+	if len(tiffs) == 0 {
+		return nil, fmt.Errorf("missing tiffs")
+	}
+	err := sanityCheck(tiffs)
+	if err != nil {
+		return nil, fmt.Errorf("consistency check: %w", err)
+	}
 	var ifds []*ifd
 	if len(tiffs) > 1 {
 		ifds, err = loadMultipleTIFFs(tiffs)
 		if err != nil {
-			return fmt.Errorf("load: %w", err)
+			return nil, fmt.Errorf("load: %w", err)
 		}
 	} else {
 		ifds, err = loadSingleTIFF(tiffs[0])
 		if err != nil {
-			return fmt.Errorf("load: %w", err)
+			return nil, fmt.Errorf("load: %w", err)
 		}
 	}
-	sort.Slice(ifds, func(i, j int) bool {
-		//return in order: fullres, fullresmasks, ovr1, ovr1masks, ovr2, ....
-		if ifds[i].ImageLength*ifds[i].ImageWidth != ifds[j].ImageLength*ifds[j].ImageWidth {
-			return ifds[i].ImageLength*ifds[i].ImageWidth > ifds[j].ImageLength*ifds[j].ImageWidth
-		}
-		return ifds[i].SubfileType < ifds[j].SubfileType
-	})
+	return cfg.assemble(ifds)
+}
+
+// assemble arranges ifds as a COG ifd tree
+func (cfg Config) assemble(ifds []*ifd) (*cog, error) {
+	var err error
+	sortIFDs(ifds)
 	if ifds[0].SubfileType != 0 {
-		return fmt.Errorf("failed sort: first px=%dx%d type=%d", ifds[0].ImageLength, ifds[0].ImageWidth, ifds[0].SubfileType)
+		return nil, fmt.Errorf("failed sort: first px=%dx%d type=%d", ifds[0].ImageLength, ifds[0].ImageWidth, ifds[0].SubfileType)
+	}
+	for _, ci := range ifds {
+		tw, th := int(ci.TileWidth), int(ci.TileLength)
+		if cfg.RequiredTileSize != [2]int{} && (tw != cfg.RequiredTileSize[0] || th != cfg.RequiredTileSize[1]) {
+			return nil, fmt.Errorf("input ifd %d (%dx%d) has %dx%d tiles, expecting %dx%d", ci.input, ci.ImageWidth, ci.ImageLength,
+				tw, th, cfg.RequiredTileSize[0], cfg.RequiredTileSize[1])
+		}
+		if cfg.UniformTileSize && (ci.TileWidth != ifds[0].TileWidth || ci.TileLength != ifds[0].TileLength) {
+			return nil, fmt.Errorf("input ifd %d (%dx%d) has %dx%d tiles, whereas the full resolution image has %dx%d tiles",
+				ci.input, ci.ImageWidth, ci.ImageLength, tw, th, ifds[0].TileWidth, ifds[0].TileLength)
+		}
 	}
 	cog := new()
+	cog.cfg = cfg
+	cog.enc = ifds[0].r.ByteOrder()
+	if cfg.Encoding != nil {
+		cog.enc = cfg.Encoding
+	}
 	cog.ifd = ifds[0]
 	curOvr := cog.ifd
+	level := 0
 	s := curOvr.ImageLength * curOvr.ImageWidth
 	for _, ci := range ifds[1:] {
 		if ci.ImageLength*ci.ImageWidth == s {
 			err = curOvr.AddMask(ci)
 			if err != nil {
-				return err
+				return nil, fmt.Errorf("input ifd %d (%dx%d) as mask of level %d: %w", ci.input, ci.ImageWidth, ci.ImageLength, level, err)
 			}
 		} else {
 			curOvr.AddOverview(ci)
 			curOvr = ci
+			level++
 			s = curOvr.ImageLength * curOvr.ImageWidth
 		}
 	}
+	if cfg.MinKeptOverviewSize > 0 {
+		for lvl := cog.ifd; lvl.overview != nil; lvl = lvl.overview {
+			ovr := lvl.overview
+			if ovr.ImageWidth < uint64(cfg.MinKeptOverviewSize) && ovr.ImageLength < uint64(cfg.MinKeptOverviewSize) {
+				lvl.overview = nil //levels are sorted by decreasing size
+				break
+			}
+		}
+	}
+	if cfg.OnIFDRole != nil {
+		level := 0
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			role := "overview"
+			if level == 0 {
+				role = "fullres"
+			}
+			cfg.OnIFDRole(lvl.input, level, role)
+			for _, msk := range lvl.masks {
+				cfg.OnIFDRole(msk.input, level, "mask")
+			}
+			level++
+		}
+	}
+	if cfg.OverviewLayout == SubIFD && cog.ifd.overview != nil {
+		n := 0
+		for ifd := cog.ifd.overview; ifd != nil; ifd = ifd.overview {
+			n++
+		}
+		cog.ifd.SubIFDs = make([]uint64, n) //offsets are set once the ifd sizes are known
+	}
+	if err = cfg.checkPyramid(cog.decimationFactors()); err != nil {
+		return nil, err
+	}
+	if cfg.DefaultSampleFormat != 0 {
+		for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+			if len(ifd.SampleFormat) == 0 {
+				ifd.SampleFormat = make([]uint16, ifd.SamplesPerPixel)
+				for i := range ifd.SampleFormat {
+					ifd.SampleFormat[i] = cfg.DefaultSampleFormat
+				}
+			}
+		}
+	}
+	if cfg.KeepGCPsOnOverviews && cog.ifd.hasGCPs() {
+		for ovr := cog.ifd.overview; ovr != nil; ovr = ovr.overview {
+			ovr.ModelTiePointTag = cog.ifd.scaledGCPs(ovr)
+		}
+	}
+	if len(cfg.Transcodings) > 0 {
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			for _, cur := range append([]*ifd{lvl}, lvl.masks...) {
+				to, ok := cfg.Transcodings[Compression(cur.Compression)]
+				if !ok {
+					continue
+				}
+				err = cur.transcode(to)
+				if err != nil {
+					return nil, fmt.Errorf("transcode %dx%d: %w", cur.ImageWidth, cur.ImageLength, err)
+				}
+			}
+		}
+	}
+	if cfg.StrictJPEG {
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			for _, cur := range append([]*ifd{lvl}, lvl.masks...) {
+				if err = cur.checkJPEGTables(); err != nil {
+					return nil, fmt.Errorf("ifd %dx%d: %w", cur.ImageWidth, cur.ImageLength, err)
+				}
+			}
+		}
+	}
+	if cfg.InlineJPEGTables {
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			for _, cur := range append([]*ifd{lvl}, lvl.masks...) {
+				if err = cur.inlineJPEGTables(); err != nil {
+					return nil, fmt.Errorf("inline jpeg tables of %dx%d: %w", cur.ImageWidth, cur.ImageLength, err)
+				}
+			}
+		}
+	}
+	if cfg.OverviewScaler != nil {
+		for ovr := cog.ifd.overview; ovr != nil; ovr = ovr.overview {
+			if err = ovr.scaleTo8Bit(cfg.OverviewScaler); err != nil {
+				return nil, fmt.Errorf("scale overview %dx%d: %w", ovr.ImageWidth, ovr.ImageLength, err)
+			}
+		}
+	}
+	if cfg.Retile != [2]int{} {
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			for _, cur := range append([]*ifd{lvl}, lvl.masks...) {
+				err = cur.retile(cfg.Retile[0], cfg.Retile[1])
+				if err != nil {
+					return nil, fmt.Errorf("retile %dx%d: %w", cur.ImageWidth, cur.ImageLength, err)
+				}
+			}
+		}
+	}
+	if cfg.ForcePlanarConfig != 0 {
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			switch {
+			case cfg.ForcePlanarConfig == lvl.planarConfiguration():
+			case cfg.ForcePlanarConfig == planarConfigurationSeparate:
+				err = lvl.separatePlanes()
+			default:
+				err = fmt.Errorf("unsupported conversion to PlanarConfiguration=%d", cfg.ForcePlanarConfig)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("planar configuration of %dx%d: %w", lvl.ImageWidth, lvl.ImageLength, err)
+			}
+		}
+	}
+	if cfg.MaskFromAlpha {
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			alpha := lvl.alphaBand()
+			if alpha < 0 || len(lvl.masks) > 0 {
+				continue
+			}
+			msk, err := maskFromAlpha(lvl, alpha)
+			if err != nil {
+				return nil, fmt.Errorf("mask from alpha of %dx%d: %w", lvl.ImageWidth, lvl.ImageLength, err)
+			}
+			if err = lvl.AddMask(msk); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(cfg.BandOrder) > 0 {
+		for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+			err = ifd.reorderBands(cfg.BandOrder)
+			if err != nil {
+				return nil, fmt.Errorf("reorder bands: %w", err)
+			}
+		}
+	}
+	for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+		for _, cur := range append([]*ifd{lvl}, lvl.masks...) {
+			if err = cur.setByteOrder(cog.enc); err != nil {
+				return nil, fmt.Errorf("ifd %dx%d: %w", cur.ImageWidth, cur.ImageLength, err)
+			}
+		}
+	}
+	if cfg.PlanarInterleaving != nil {
+		nmasks := 0
+		for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+			if len(ifd.masks) > nmasks {
+				nmasks = len(ifd.masks)
+			}
+		}
+		for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+			err = cfg.PlanarInterleaving.validate(ifd.planeCount(), nmasks)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfg.Photometric != nil {
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			if err = lvl.setPhotometric(*cfg.Photometric); err != nil {
+				return nil, fmt.Errorf("ifd %dx%d: %w", lvl.ImageWidth, lvl.ImageLength, err)
+			}
+		}
+	}
+	if cfg.CRS != nil {
+		if err = cog.ifd.setCRS(*cfg.CRS); err != nil {
+			return nil, fmt.Errorf("set crs: %w", err)
+		}
+	}
+	if cfg.AuxXML != nil {
+		md, nodata, err := MergeAuxXML(cog.ifd.GDALMetaData, bytes.NewReader(cfg.AuxXML))
+		if err != nil {
+			return nil, err
+		}
+		cog.ifd.GDALMetaData = md
+		if cog.ifd.NoData == "" {
+			cog.ifd.NoData = nodata
+		}
+	}
+	if cfg.NoData != nil {
+		nodata := strings.TrimSpace(*cfg.NoData)
+		for lvl := cog.ifd; lvl != nil; lvl = lvl.overview {
+			lvl.NoData = nodata
+		}
+	}
+	if cfg.MetadataRewriter != nil {
+		level := 0
+		for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+			ifd.GDALMetaData, err = cfg.MetadataRewriter(level, false, ifd.GDALMetaData)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite metadata of level %d: %w", level, err)
+			}
+			for _, msk := range ifd.masks {
+				msk.GDALMetaData, err = cfg.MetadataRewriter(level, true, msk.GDALMetaData)
+				if err != nil {
+					return nil, fmt.Errorf("rewrite metadata of level %d mask: %w", level, err)
+				}
+			}
+			level++
+		}
+	}
+	return cog, nil
+}
 
-	err = cog.write(out)
+// sortIFDs orders ifds as fullres, fullresmasks, ovr1, ovr1masks, ovr2, ....
+func sortIFDs(ifds []*ifd) {
+	sort.Slice(ifds, func(i, j int) bool {
+		if ifds[i].ImageLength*ifds[i].ImageWidth != ifds[j].ImageLength*ifds[j].ImageWidth {
+			return ifds[i].ImageLength*ifds[i].ImageWidth > ifds[j].ImageLength*ifds[j].ImageWidth
+		}
+		return ifds[i].SubfileType < ifds[j].SubfileType
+	})
+}
+
+// DecimationFactors returns the ratios between the widths of consecutive levels
+// of the COG that cfg would create from readers, e.g. [2 2 4] for a pyramid
+// whose third overview level is missing. Tile data is not read, unless cfg
+// requires it to assemble the COG (e.g. Retile).
+func (cfg Config) DecimationFactors(readers ...tiff.ReadAtReadSeeker) ([]float64, error) {
+	tiffs, err := parseReaders(readers)
 	if err != nil {
-		return fmt.Errorf("mucog write: %w", err)
+		return nil, err
+	}
+	cog, err := cfg.newCOG(tiffs)
+	if err != nil {
+		return nil, err
+	}
+	return cog.decimationFactors(), nil
+}
+
+// decimationFactors returns the ratios between the widths of consecutive levels
+func (cog *cog) decimationFactors() []float64 {
+	levels := []*ifd{}
+	for ifd := cog.ifd; ifd != nil; ifd = ifd.overview {
+		levels = append(levels, ifd)
+	}
+	return decimationFactors(levels)
+}
+
+// checkPyramid returns an error under StrictPyramid if the rounded factors are
+// not all the same, and reports it and factors that are not powers of two to
+// OnPyramidWarning otherwise
+func (cfg Config) checkPyramid(factors []float64) error {
+	for _, f := range factors {
+		if math.Round(f) != math.Round(factors[0]) {
+			if cfg.StrictPyramid {
+				return fmt.Errorf("inconsistent decimation factors %v: an overview level may be missing", factors)
+			}
+			if cfg.OnPyramidWarning != nil {
+				cfg.OnPyramidWarning(fmt.Sprintf("inconsistent decimation factors %v: an overview level may be missing", factors))
+			}
+			break
+		}
+	}
+	if cfg.OnPyramidWarning == nil {
+		return nil
+	}
+	for _, f := range factors {
+		if r := int(math.Round(f)); r < 2 || r&(r-1) != 0 {
+			cfg.OnPyramidWarning(fmt.Sprintf("decimation factors %v are not all powers of two", factors))
+			break
+		}
 	}
 	return nil
 }
 
+// decimationFactors returns the ratio between the widths of consecutive levels
+func decimationFactors(levels []*ifd) []float64 {
+	factors := []float64{}
+	for i := 1; i < len(levels); i++ {
+		factors = append(factors, float64(levels[i-1].ImageWidth)/float64(levels[i].ImageWidth))
+	}
+	return factors
+}
+
 func sanityCheck(tiffs []tiff.TIFF) error {
 	if len(tiffs) == 0 {
 		return fmt.Errorf("no tiffs")
 	}
-	order := tiffs[0].Order()
-	if order != "MM" && order != "II" {
-		return fmt.Errorf("unknown byte order")
-	}
 	for it, tif := range tiffs {
-		if tif.Order() != order {
-			return fmt.Errorf("inconsistent byte order")
+		if order := tif.Order(); order != "MM" && order != "II" {
+			return fmt.Errorf("tif %d: unknown byte order", it)
 		}
 		for ii, ifd := range tif.IFDs() {
 			err := sanityCheckIFD(ifd)
@@ -0,0 +1,628 @@
+package cogger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/tiff"
+)
+
+func TestRewriteParsed(t *testing.T) {
+	tiffs := []tiff.TIFF{}
+	for _, name := range []string{"exttest.tif", "exttest.tif.ovr"} {
+		f, err := os.Open("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		tif, err := tiff.Parse(f, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tiffs = append(tiffs, tif)
+	}
+	buf := bytes.Buffer{}
+	if err := DefaultConfig().RewriteParsed(&buf, tiffs...); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := os.ReadFile("testdata/cog_ext_ovr.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), ref) {
+		t.Error("mismatch with cog_ext_ovr.tif")
+	}
+}
+
+func TestRewriteHeader(t *testing.T) {
+	cog, err := os.ReadFile("testdata/cog_graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr := bytes.Buffer{}
+	if err := DefaultConfig().RewriteHeader(&hdr, 0, bytes.NewReader(cog)); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(cog, hdr.Bytes()) {
+		t.Error("regenerated header differs from original")
+	}
+
+	hdr.Reset()
+	if err := DefaultConfig().RewriteHeader(&hdr, 1000, bytes.NewReader(cog)); err != nil {
+		t.Fatal(err)
+	}
+	orig := parseIFDs(t, cog)
+	shifted := parseIFDs(t, append(hdr.Bytes(), make([]byte, len(cog)+1000-hdr.Len())...))
+	for i := range orig {
+		for j, off := range orig[i].OriginalTileOffsets {
+			if shifted[i].OriginalTileOffsets[j] != off+1000 {
+				t.Errorf("ifd %d tile %d: offset %d, expected %d", i, j, shifted[i].OriginalTileOffsets[j], off+1000)
+			}
+		}
+	}
+
+	//a header that grows would overwrite the first tiles
+	cfg := DefaultConfig()
+	cfg.MetadataRewriter = func(level int, mask bool, md string) (string, error) {
+		return AddMetadataDomain(md, "", map[string]string{"DESCRIPTION": strings.Repeat("x", 100)})
+	}
+	err = cfg.RewriteHeader(io.Discard, 0, bytes.NewReader(cog))
+	if err == nil || !strings.Contains(err.Error(), "overlaps the tile data") {
+		t.Errorf("expected an overlap error, got %v", err)
+	}
+	if err = cfg.RewriteHeader(io.Discard, 1000, bytes.NewReader(cog)); err != nil {
+		t.Error(err)
+	}
+
+	//offsets past 4GB require a bigtiff
+	cfg = DefaultConfig()
+	cfg.NoBigTIFFPromotion = true
+	err = cfg.RewriteHeader(io.Discard, 1<<32, bytes.NewReader(cog))
+	if err == nil || !strings.Contains(err.Error(), "overflows a classic tiff") {
+		t.Errorf("expected an overflow error, got %v", err)
+	}
+	hdr.Reset()
+	if err = DefaultConfig().RewriteHeader(&hdr, 1<<32, bytes.NewReader(cog)); err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Bytes()[2] != 43 {
+		t.Error("header was not promoted to bigtiff")
+	}
+}
+
+func TestRewriteHeaderModifiedTiles(t *testing.T) {
+	gray := func() *ifd {
+		return withTiles(grayIFD(32, 32, 16), make([]byte, 256), make([]byte, 256), make([]byte, 256), make([]byte, 256))
+	}
+	rgba := func() *ifd {
+		img := withTiles(grayIFD(16, 16, 16), make([]byte, 16*16*4))
+		img.SamplesPerPixel = 4
+		img.BitsPerSample = []uint16{8, 8, 8, 8}
+		img.SampleFormat = []uint16{1, 1, 1, 1}
+		img.ExtraSamples = []uint16{extraSamplesUnassAlpha}
+		img.PhotometricInterpretation = photometricInterpretationRGB
+		return img
+	}
+	wide := func() *ifd {
+		img := withTiles(grayIFD(16, 16, 16), make([]byte, 16*16*2))
+		img.BitsPerSample = []uint16{16}
+		return img
+	}
+	jpegIFD := func() *ifd {
+		img := withTiles(grayIFD(16, 16, 16), []byte{0xff, 0xd8, 0xff, 0xda, 0xff, 0xd9})
+		img.Compression = compressionJPEG
+		img.JPEGTables = []byte{0xff, 0xd8, 0xff, 0xdb, 0, 2, 0xff, 0xd9}
+		return img
+	}
+
+	for _, tc := range []struct {
+		name string
+		src  []byte
+		cfg  func(*Config)
+	}{
+		{"byte order", func() []byte {
+			c := new()
+			c.cfg = DefaultConfig()
+			c.enc = binary.BigEndian
+			c.ifd = wide()
+			buf := bytes.Buffer{}
+			if err := c.write(&buf); err != nil {
+				t.Fatal(err)
+			}
+			return buf.Bytes()
+		}(), func(c *Config) { c.Encoding = binary.LittleEndian }},
+		{"retile", encodeTIFF(t, gray()), func(c *Config) { c.Retile = [2]int{32, 32} }},
+		{"band order", encodeTIFF(t, rgba()), func(c *Config) { c.BandOrder = []int{2, 1, 0, 3} }},
+		{"transcoding", encodeTIFF(t, gray()), func(c *Config) { c.Transcode(CompressionNone, CompressionLZW) }},
+		{"mask from alpha", encodeTIFF(t, rgba()), func(c *Config) { c.MaskFromAlpha = true }},
+		{"inline jpeg tables", encodeTIFF(t, jpegIFD()), func(c *Config) { c.InlineJPEGTables = true }},
+		{"planar config", encodeTIFF(t, rgba()), func(c *Config) { c.ForcePlanarConfig = planarConfigurationSeparate }},
+		{"overview scaler", encodeTIFF(t, withOverviews(withTiles(grayIFD(32, 32, 16), make([]byte, 512), make([]byte, 512), make([]byte, 512), make([]byte, 512)), wide())),
+			func(c *Config) {
+				c.OverviewScaler = func(band int, v uint16) uint8 { return uint8(v >> 8) }
+			}},
+	} {
+		cfg := DefaultConfig()
+		tc.cfg(&cfg)
+		if err := cfg.Rewrite(io.Discard, bytes.NewReader(tc.src)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		err := cfg.RewriteHeader(io.Discard, 0, bytes.NewReader(tc.src))
+		if err == nil || !strings.Contains(err.Error(), "tile data is modified by the configuration") {
+			t.Errorf("%s: expected an error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestMissingPlanarConfiguration(t *testing.T) {
+	rgb := grayIFD(512, 256, 256)
+	rgb.SamplesPerPixel = 3
+	rgb.BitsPerSample = []uint16{8, 8, 8}
+	rgb.PhotometricInterpretation = photometricInterpretationRGB
+	rgb.PlanarConfiguration = 0
+	src := encodeTIFF(t, withTiles(rgb, []byte("tile0"), []byte("tile1")))
+	tif, err := tiff.Parse(bytes.NewReader(src), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tif.IFDs()[0].HasField(284) {
+		t.Fatal("source has a PlanarConfiguration tag")
+	}
+	buf := bytes.Buffer{}
+	if err := Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ifd := parseIFDs(t, buf.Bytes())[0]
+	if len(ifd.TileByteCounts) != 2 {
+		t.Errorf("got %d tiles, expected 2 chunky tiles", len(ifd.TileByteCounts))
+	}
+	eq, diff, err := TilesEqual(bytes.NewReader(src), bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !eq {
+		t.Error(diff)
+	}
+}
+
+func TestRewriteDataThenHeader(t *testing.T) {
+	src, err := os.ReadFile("testdata/rgbmask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := bytes.Buffer{}
+	if err := Rewrite(&ref, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Buffer{}
+	header, err := DefaultConfig().RewriteDataThenHeader(&data, bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(append(header, data.Bytes()...), ref.Bytes()) {
+		t.Error("header+data differs from Rewrite output")
+	}
+}
+
+func TestExtractHeader(t *testing.T) {
+	for _, name := range []string{"gray.tif", "rgbmask.tif", "band4mask.tif", "exttest.tif"} {
+		src, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, layout := range []OverviewLayout{ChainedIFD, SubIFD} {
+			cfg := DefaultConfig()
+			cfg.OverviewLayout = layout
+			cfg.VerifyLayout = true
+			ref := bytes.Buffer{}
+			if err := cfg.Rewrite(&ref, bytes.NewReader(src)); err != nil {
+				t.Fatal(err)
+			}
+			header, err := cfg.ExtractHeader(bytes.NewReader(src))
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if len(header) >= ref.Len() || !bytes.Equal(header, ref.Bytes()[:len(header)]) {
+				t.Errorf("%s: header is not a prefix of the cog", name)
+			}
+			first := ^uint64(0)
+			for _, ifd := range parseIFDs(t, ref.Bytes()) {
+				for i, off := range ifd.OriginalTileOffsets {
+					if ifd.TileByteCounts[i] > 0 && off < first {
+						first = off
+					}
+				}
+			}
+			if first != uint64(len(header))+4 { //block leader
+				t.Errorf("%s: header of %d bytes, first tile at %d", name, len(header), first)
+			}
+		}
+	}
+
+	//tile data is not read
+	img := withTiles(grayIFD(512, 256, 256), []byte("image0"), []byte("image1"))
+	src := encodeTIFF(t, img)
+	bad := int64(parseIFDs(t, src)[0].OriginalTileOffsets[1])
+	if _, err := DefaultConfig().ExtractHeader(&failingReader{bytes.NewReader(src), bad, 0}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOnIFDRole(t *testing.T) {
+	img := withTiles(grayIFD(512, 256, 256), []byte("i0"), []byte("i1"))
+	msk := withTiles(grayIFD(512, 256, 256), []byte("m0"), []byte("m1"))
+	msk.PhotometricInterpretation = photometricInterpretationMask
+	if err := img.AddMask(msk); err != nil {
+		t.Fatal(err)
+	}
+	ovr := withTiles(grayIFD(256, 128, 256), []byte("o0"))
+
+	roles := []string{}
+	cfg := DefaultConfig()
+	cfg.OnIFDRole = func(idx, level int, role string) {
+		roles = append(roles, fmt.Sprintf("%d:%d:%s", idx, level, role))
+	}
+	err := cfg.Rewrite(io.Discard, bytes.NewReader(encodeTIFF(t, img)), bytes.NewReader(encodeTIFF(t, ovr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(roles) != "[0:0:fullres 1:0:mask 2:1:overview]" {
+		t.Errorf("unexpected roles %v", roles)
+	}
+
+	//dropped overviews are not reported
+	roles = roles[:0]
+	cfg.MinKeptOverviewSize = 300
+	err = cfg.Rewrite(io.Discard, bytes.NewReader(encodeTIFF(t, img)), bytes.NewReader(encodeTIFF(t, ovr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(roles) != "[0:0:fullres 1:0:mask]" {
+		t.Errorf("unexpected roles %v", roles)
+	}
+}
+
+func TestStrictPyramid(t *testing.T) {
+	for _, tc := range []struct {
+		widths   []uint64
+		valid    bool
+		factors  string
+		warnings int
+	}{
+		{[]uint64{1024, 512, 256}, true, "[2 2]", 0},
+		{[]uint64{1000, 500, 250}, true, "[2 2]", 0},
+		{[]uint64{1024, 512, 128}, false, "[2 4]", 1}, //missing 256 level
+		{[]uint64{900, 300, 100}, true, "[3 3]", 1},
+	} {
+		src := encodeTIFF(t, grayPyramid(tc.widths...))
+		warnings := 0
+		cfg := DefaultConfig()
+		cfg.OnPyramidWarning = func(string) { warnings++ }
+		if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err != nil {
+			t.Fatalf("%v: %v", tc.widths, err)
+		}
+		if warnings != tc.warnings {
+			t.Errorf("%v: got %d warnings, expected %d", tc.widths, warnings, tc.warnings)
+		}
+		factors, err := cfg.DecimationFactors(bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(factors) != tc.factors {
+			t.Errorf("%v: got decimation factors %v, expected %s", tc.widths, factors, tc.factors)
+		}
+		cfg = DefaultConfig()
+		cfg.StrictPyramid = true
+		err = cfg.Rewrite(io.Discard, bytes.NewReader(src))
+		if (err == nil) != tc.valid {
+			t.Errorf("%v: strict pyramid error %v", tc.widths, err)
+		}
+	}
+}
+
+func TestMinKeptOverviewSize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MinKeptOverviewSize = 1000
+	widths := []uint64{}
+	for _, ifd := range rewriteIFDs(t, cfg, grayPyramid(4096, 2048, 1024, 512, 256)) {
+		widths = append(widths, ifd.ImageWidth)
+	}
+	if fmt.Sprint(widths) != "[4096 2048 1024]" {
+		t.Errorf("kept levels %v, expected [4096 2048 1024]", widths)
+	}
+}
+
+func TestRewritePages(t *testing.T) {
+	a := bytes.Repeat([]byte{1}, 256*256)
+	b := bytes.Repeat([]byte{2}, 256*256)
+	c := bytes.Repeat([]byte{3}, 256*256)
+	page0 := withTiles(grayIFD(512, 512, 256), a, a, a, a)
+	page0.SubfileType = subfileTypePage
+	page0.PageNumber = []uint16{0, 2}
+	ovr := withTiles(grayIFD(256, 256, 256), b)
+	ovr.SubfileType = subfileTypePage | subfileTypeReducedImage
+	page1 := withTiles(grayIFD(256, 256, 256), c)
+	page1.SubfileType = subfileTypePage
+	page1.PageNumber = []uint16{1, 2}
+	page0.overview = ovr
+	ovr.overview = page1
+	src := encodeTIFF(t, page0)
+
+	outs := map[int]*bytes.Buffer{}
+	err := DefaultConfig().RewritePages(func(page int) io.Writer {
+		outs[page] = &bytes.Buffer{}
+		return outs[page]
+	}, bytes.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outs) != 2 || outs[0] == nil || outs[1] == nil {
+		t.Fatalf("got pages %v, expected 0 and 1", outs)
+	}
+	for page, expected := range map[int][][]byte{0: {a, b}, 1: {c}} {
+		ifds := parseIFDs(t, outs[page].Bytes())
+		if len(ifds) != len(expected) {
+			t.Fatalf("page %d: got %d ifds, expected %d", page, len(ifds), len(expected))
+		}
+		for i, ifd := range ifds {
+			if ifd.SubfileType&subfileTypePage != 0 || len(ifd.PageNumber) != 0 {
+				t.Errorf("page %d ifd %d: SubfileType %d, PageNumber %v", page, i, ifd.SubfileType, ifd.PageNumber)
+			}
+			if tiles := decodedTiles(t, ifd); !bytes.Equal(tiles[0], expected[i]) {
+				t.Errorf("page %d ifd %d: unexpected tile content", page, i)
+			}
+		}
+	}
+}
+
+func TestMixedByteOrders(t *testing.T) {
+	a := bytes.Repeat([]byte{1}, 256*256)
+	b := bytes.Repeat([]byte{2}, 256*256)
+	main := encodeTIFF(t, withTiles(grayIFD(512, 512, 256), a, a, a, a))
+	c := new()
+	c.cfg = DefaultConfig()
+	c.enc = binary.BigEndian
+	c.ifd = withTiles(grayIFD(256, 256, 256), b)
+	ovr := bytes.Buffer{}
+	if err := c.write(&ovr); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	if err := Rewrite(&buf, bytes.NewReader(main), bytes.NewReader(ovr.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	if len(ifds) != 2 || ifds[1].ImageWidth != 256 {
+		t.Fatalf("got %d ifds", len(ifds))
+	}
+	if tiles := decodedTiles(t, ifds[1]); !bytes.Equal(tiles[0], b) {
+		t.Error("unexpected overview tile content")
+	}
+
+	//wide samples of the inputs are converted to the output byte order
+	main16 := grayIFD(512, 512, 256)
+	main16.BitsPerSample = []uint16{16}
+	src16 := encodeTIFF(t, withTiles(main16, a, a, a, a))
+	ovr16 := make([]byte, 256*256*2)
+	for i := 0; i < 256*256; i++ {
+		binary.BigEndian.PutUint16(ovr16[2*i:], uint16(i))
+	}
+	c.ifd = withTiles(grayIFD(256, 256, 256), ovr16)
+	c.ifd.BitsPerSample = []uint16{16}
+	ovr.Reset()
+	if err := c.write(&ovr); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := Rewrite(&buf, bytes.NewReader(src16), bytes.NewReader(ovr.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	ifds = parseIFDs(t, buf.Bytes())
+	tile := rawTile(t, ifds[1], 0)
+	for i := 0; i < 256*256; i++ {
+		if v := binary.LittleEndian.Uint16(tile[2*i:]); v != uint16(i) {
+			t.Fatalf("overview sample %d is %d, expected %d", i, v, i)
+		}
+	}
+}
+
+func TestFlipByteOrder(t *testing.T) {
+	samples := func(seed int) []byte {
+		pix := make([]byte, 16*16*2)
+		for i := 0; i < 16*16; i++ {
+			binary.LittleEndian.PutUint16(pix[2*i:], uint16(seed*1000+i*257))
+		}
+		return pix
+	}
+	level := func(w, h uint64, compression, predictor uint16) *ifd {
+		img := grayIFD(w, h, 16)
+		img.BitsPerSample = []uint16{16}
+		img.Compression, img.Predictor = compression, predictor
+		tiles := [][]byte{}
+		for i := 0; i < int(w/16*h/16); i++ {
+			tile, err := compress(compression, samples(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tiles = append(tiles, tile)
+		}
+		return withTiles(img, tiles...)
+	}
+	for _, tc := range []struct {
+		name                   string
+		compression, predictor uint16
+	}{
+		{"none", compressionNone, 0},
+		{"lzw", compressionLZW, 0},
+		{"deflate predictor", compressionDeflate, predictorHorizontal},
+	} {
+		src := encodeTIFF(t, withOverviews(level(32, 32, tc.compression, tc.predictor), level(16, 16, tc.compression, tc.predictor)))
+
+		cfg := DefaultConfig()
+		cfg.Encoding = binary.BigEndian
+		be := bytes.Buffer{}
+		if err := cfg.Rewrite(&be, bytes.NewReader(src)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !bytes.HasPrefix(be.Bytes(), []byte("MM")) {
+			t.Fatalf("%s: output is not big endian", tc.name)
+		}
+		for l, ifd := range parseIFDs(t, be.Bytes()) {
+			if ifd.Compression != tc.compression || ifd.Predictor != tc.predictor {
+				t.Errorf("%s: level %d has compression %d and predictor %d", tc.name, l, ifd.Compression, ifd.Predictor)
+			}
+			for i := range ifd.TileByteCounts {
+				pix, err := decompress(ifd.Compression, rawTile(t, ifd, i), 16*16*2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				exp := samples(i)
+				for s := 0; s < 16*16; s++ {
+					if binary.BigEndian.Uint16(pix[2*s:]) != binary.LittleEndian.Uint16(exp[2*s:]) {
+						t.Fatalf("%s: level %d tile %d: sample %d differs", tc.name, l, i, s)
+					}
+				}
+			}
+		}
+
+		//flipping back gives the same result as a direct little endian rewrite
+		le, back := bytes.Buffer{}, bytes.Buffer{}
+		if err := Rewrite(&le, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		//by default, the byte order of the input is kept and tiles are copied as is
+		keep := bytes.Buffer{}
+		if err := Rewrite(&keep, bytes.NewReader(be.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(keep.Bytes(), be.Bytes()) {
+			t.Errorf("%s: big endian rewrite is not idempotent", tc.name)
+		}
+		cfg.Encoding = binary.LittleEndian
+		if err := cfg.Rewrite(&back, bytes.NewReader(be.Bytes())); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(le.Bytes(), back.Bytes()) {
+			t.Errorf("%s: little endian round trip differs", tc.name)
+		}
+	}
+
+	zstd := withTiles(grayIFD(16, 16, 16), []byte{1, 2, 3})
+	zstd.BitsPerSample = []uint16{16}
+	zstd.Compression = 50000
+	cfg := DefaultConfig()
+	cfg.Encoding = binary.BigEndian
+	err := cfg.Rewrite(io.Discard, bytes.NewReader(encodeTIFF(t, zstd)))
+	if err == nil || !strings.Contains(err.Error(), "cannot change the byte order of 16 bit ZSTD tiles") {
+		t.Errorf("expected a byte order error, got %v", err)
+	}
+	zstd.BitsPerSample = []uint16{8}
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(encodeTIFF(t, zstd))); err != nil {
+		t.Errorf("8 bit zstd: %v", err)
+	}
+
+	//jpeg and lerc streams do not depend on the byte order of the file
+	for _, tc := range []struct {
+		name        string
+		compression uint16
+		bits        uint16
+	}{
+		{"12 bit jpeg", compressionJPEG, 12},
+		{"16 bit lerc", compressionLERC, 16},
+	} {
+		tile := []byte{0xff, 0xd8, 1, 2, 3, 4, 5}
+		img := withTiles(grayIFD(16, 16, 16), tile)
+		img.BitsPerSample = []uint16{tc.bits}
+		img.Compression = tc.compression
+		out := bytes.Buffer{}
+		if err := cfg.Rewrite(&out, bytes.NewReader(encodeTIFF(t, img))); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := rawTile(t, parseIFDs(t, out.Bytes())[0], 0); !bytes.Equal(got, tile) {
+			t.Errorf("%s: tile was modified: %v", tc.name, got)
+		}
+	}
+}
+
+func TestRewriteWithHash(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	h := sha256.New()
+	if err := DefaultConfig().RewriteWithHash(&buf, h, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(buf.Bytes()); !bytes.Equal(h.Sum(nil), sum[:]) {
+		t.Errorf("hash %x, expected %x", h.Sum(nil), sum)
+	}
+}
+
+func TestAssertIdempotent(t *testing.T) {
+	for _, name := range []string{"gray.tif", "graymask.tif", "rgbmask.tif", "band4mask.tif", "exttest.tif"} {
+		src, err := os.ReadFile("testdata/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := AssertIdempotent(bytes.NewReader(src)); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := AssertIdempotent(bytes.NewReader([]byte("not a tiff"))); err == nil {
+		t.Error("expected an error for an invalid input")
+	}
+}
+
+func TestHeterogeneousMasks(t *testing.T) {
+	main := withTiles(grayIFD(512, 512, 256), []byte{1}, []byte{2}, []byte{3}, []byte{4})
+	ovr := withTiles(grayIFD(256, 256, 256), []byte{5})
+	msk := withTiles(grayIFD(256, 256, 256), []byte{6})
+	msk.SubfileType = subfileTypeReducedImage | subfileTypeMask
+	msk.PhotometricInterpretation = photometricInterpretationMask
+	ovr.masks = []*ifd{msk}
+	src := encodeTIFF(t, withOverviews(main, ovr))
+	for _, pi := range []PlanarInterleaving{nil, MaskSeparateInterleaving(1)} {
+		cfg := DefaultConfig()
+		cfg.PlanarInterleaving = pi
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatalf("%v: %v", pi, err)
+		}
+		ifds := parseIFDs(t, buf.Bytes())
+		types := []uint32{}
+		for _, ifd := range ifds {
+			types = append(types, ifd.SubfileType)
+		}
+		if fmt.Sprint(types) != "[0 1 5]" {
+			t.Errorf("%v: subfile types %v", pi, types)
+		}
+		if tile := rawTile(t, ifds[2], 0); !bytes.Equal(tile, []byte{6}) {
+			t.Errorf("%v: unexpected mask tile %v", pi, tile)
+		}
+	}
+}
+
+func TestOddOverviewSizes(t *testing.T) {
+	//overviews of odd sized levels rounded down then up, as different tools do
+	main := grayPyramid(16001, 8000, 4001, 2000)
+	cfg := DefaultConfig()
+	cfg.StrictPyramid = true
+	roles := []string{}
+	cfg.OnIFDRole = func(idx, level int, role string) {
+		roles = append(roles, fmt.Sprintf("%d:%s", level, role))
+	}
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(encodeTIFF(t, main))); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(roles) != "[0:fullres 1:overview 2:overview 3:overview]" {
+		t.Errorf("unexpected roles %v", roles)
+	}
+}
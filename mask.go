@@ -0,0 +1,115 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/tiff"
+)
+
+// alphaBand returns the index of the ifd's alpha band, or -1 if it has none
+func (ifd *ifd) alphaBand() int {
+	first := int(ifd.SamplesPerPixel) - len(ifd.ExtraSamples)
+	for i, es := range ifd.ExtraSamples {
+		if es == extraSamplesAssocAlpha || es == extraSamplesUnassAlpha {
+			return first + i
+		}
+	}
+	return -1
+}
+
+// maskFromAlpha builds an 8 bit deflate compressed mask ifd from the given
+// band of img: mask pixels are 255 where alpha is non zero, 0 elsewhere. The
+// alpha tiles must be decoded, which is only supported for uncompressed, LZW and
+// deflate tiles with byte aligned samples (the horizontal predictor requires an
+// 8 bit alpha band). The mask tiles are kept in memory.
+func maskFromAlpha(img *ifd, alphaBand int) (*ifd, error) {
+	spp := int(img.SamplesPerPixel)
+	if alphaBand < 0 || alphaBand >= spp {
+		return nil, fmt.Errorf("invalid alpha band %d for %d bands", alphaBand, spp)
+	}
+	if len(img.BitsPerSample) != spp {
+		return nil, fmt.Errorf("expecting %d BitsPerSample values, got %d", spp, len(img.BitsPerSample))
+	}
+	if img.Predictor == predictorFloatingPoint ||
+		(img.Predictor == predictorHorizontal && img.BitsPerSample[alphaBand] != 8) {
+		return nil, fmt.Errorf("unsupported predictor %d for %d bit alpha", img.Predictor, img.BitsPerSample[alphaBand])
+	}
+	soff := 0 //offset of the alpha sample inside a pixel
+	for b := 0; b < alphaBand; b++ {
+		soff += int(img.BitsPerSample[b]) / 8
+	}
+	ssize := int(img.BitsPerSample[alphaBand]) / 8
+	psize := img.pixelSize()
+	if psize == 0 || ssize == 0 {
+		return nil, fmt.Errorf("unsupported BitsPerSample %v", img.BitsPerSample)
+	}
+	npix := int(img.TileWidth) * int(img.TileLength)
+	ntiles := len(img.TileByteCounts)
+	first := 0 //index of the first alpha tile
+	if img.planarConfiguration() == planarConfigurationSeparate {
+		ntiles /= spp
+		first = alphaBand * ntiles
+		soff = 0
+	}
+
+	msk := &ifd{
+		ImageWidth:                img.ImageWidth,
+		ImageLength:               img.ImageLength,
+		BitsPerSample:             []uint16{8},
+		Compression:               compressionDeflate,
+		PhotometricInterpretation: photometricInterpretationMask,
+		SamplesPerPixel:           1,
+		PlanarConfiguration:       planarConfigurationContig,
+		TileWidth:                 img.TileWidth,
+		TileLength:                img.TileLength,
+		SampleFormat:              []uint16{sampleFormatUInt},
+		OriginalTileOffsets:       make([]uint64, ntiles),
+		TileByteCounts:            make([]uint32, ntiles),
+		inMemory:                  true,
+	}
+	data := []byte{}
+	buf := []byte{}
+	pix := make([]byte, npix)
+	for i := 0; i < ntiles; i++ {
+		bc := int(img.TileByteCounts[first+i])
+		if bc == 0 {
+			continue
+		}
+		if len(buf) < bc {
+			buf = make([]byte, bc)
+		}
+		if n, err := img.r.ReadAt(buf[:bc], int64(img.OriginalTileOffsets[first+i])); n < bc {
+			return nil, fmt.Errorf("read tile %d: %w", first+i, err)
+		}
+		dec, err := decompress(img.Compression, buf[:bc], npix*psize)
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", first+i, err)
+		}
+		tw := int(img.TileWidth)
+		for p := 0; p < npix; p++ {
+			pix[p] = 0
+			if img.Predictor == predictorHorizontal {
+				//undo horizontal differencing of the (8 bit) alpha sample
+				if p%tw != 0 {
+					dec[p*psize+soff] += dec[(p-1)*psize+soff]
+				}
+			}
+			for _, v := range dec[p*psize+soff : p*psize+soff+ssize] {
+				if v != 0 {
+					pix[p] = 255
+					break
+				}
+			}
+		}
+		tile, err := compress(compressionDeflate, pix)
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", first+i, err)
+		}
+		msk.OriginalTileOffsets[i] = uint64(len(data))
+		msk.TileByteCounts[i] = uint32(len(tile))
+		data = append(data, tile...)
+	}
+	msk.r = tiff.NewBReader(bytes.NewReader(data), img.r.ByteOrder())
+	return msk, nil
+}
@@ -0,0 +1,196 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestAlphaAndMask(t *testing.T) {
+	rgba := grayIFD(512, 256, 256)
+	rgba.SamplesPerPixel = 4
+	rgba.BitsPerSample = []uint16{8, 8, 8, 8}
+	rgba.SampleFormat = []uint16{1, 1, 1, 1}
+	rgba.ExtraSamples = []uint16{extraSamplesUnassAlpha}
+	rgba.PhotometricInterpretation = photometricInterpretationRGB
+	msk := grayIFD(512, 256, 256)
+	msk.BitsPerSample = []uint16{1}
+	msk.PhotometricInterpretation = photometricInterpretationMask
+	withTiles(rgba, []byte("rgba0"), []byte("rgba1"))
+	withTiles(msk, []byte("mask0"), []byte("mask1"))
+	if err := rgba.AddMask(msk); err != nil {
+		t.Fatal(err)
+	}
+	src := encodeTIFF(t, rgba)
+
+	buf := bytes.Buffer{}
+	if err := Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	if len(ifds) != 2 || ifds[1].SubfileType != subfileTypeMask {
+		t.Fatalf("expected an image and a mask ifd")
+	}
+	if len(ifds[0].ExtraSamples) != 1 || ifds[0].ExtraSamples[0] != extraSamplesUnassAlpha {
+		t.Errorf("alpha extrasample lost: %v", ifds[0].ExtraSamples)
+	}
+	//each image tile must be directly followed by its mask tile
+	img, mask := ifds[0].OriginalTileOffsets, ifds[1].OriginalTileOffsets
+	if !(img[0] < mask[0] && mask[0] < img[1] && img[1] < mask[1]) {
+		t.Errorf("unexpected interleaving: image %v, mask %v", img, mask)
+	}
+	for i, off := range mask {
+		if string(buf.Bytes()[off:off+5]) != fmt.Sprintf("mask%d", i) {
+			t.Errorf("mask tile %d misplaced", i)
+		}
+	}
+}
+
+func TestMaskFromAlpha(t *testing.T) {
+	//alpha is opaque on the left half of each tile row
+	alpha := func(x int) byte {
+		if x%16 < 8 {
+			return 200
+		}
+		return 0
+	}
+	rgba := func(planar bool, compression uint16, predictor uint16) *ifd {
+		img := grayIFD(32, 16, 16)
+		img.SamplesPerPixel = 4
+		img.BitsPerSample = []uint16{8, 8, 8, 8}
+		img.SampleFormat = []uint16{1, 1, 1, 1}
+		img.ExtraSamples = []uint16{extraSamplesUnassAlpha}
+		img.PhotometricInterpretation = photometricInterpretationRGB
+		img.Compression = compression
+		img.Predictor = predictor
+		tiles := [][]byte{}
+		if planar {
+			img.PlanarConfiguration = planarConfigurationSeparate
+			for b := 0; b < 4; b++ {
+				for tx := 0; tx < 2; tx++ {
+					pix := make([]byte, 16*16)
+					for i := range pix {
+						pix[i] = byte(10 * b)
+						if b == 3 {
+							pix[i] = alpha(i)
+						}
+					}
+					tiles = append(tiles, pix)
+				}
+			}
+		} else {
+			for tx := 0; tx < 2; tx++ {
+				pix := make([]byte, 16*16*4)
+				for i := 0; i < 16*16; i++ {
+					copy(pix[i*4:], []byte{1, 2, 3, alpha(i)})
+					if predictor == predictorHorizontal && i%16 != 0 {
+						copy(pix[i*4:], []byte{0, 0, 0, alpha(i) - alpha(i-1)})
+					}
+				}
+				tiles = append(tiles, pix)
+			}
+		}
+		for i := range tiles {
+			enc, err := compress(compression, tiles[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			tiles[i] = enc
+		}
+		return withTiles(img, tiles...)
+	}
+
+	for _, tc := range []struct {
+		name string
+		img  *ifd
+	}{
+		{"chunky", rgba(false, compressionNone, 0)},
+		{"chunky predictor", rgba(false, compressionLZW, predictorHorizontal)},
+		{"planar", rgba(true, compressionDeflate, 0)},
+	} {
+		src := encodeTIFF(t, tc.img)
+		cfg := DefaultConfig()
+		cfg.MaskFromAlpha = true
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		ifds := parseIFDs(t, buf.Bytes())
+		if len(ifds) != 2 || ifds[1].SubfileType != subfileTypeMask ||
+			ifds[1].PhotometricInterpretation != photometricInterpretationMask {
+			t.Fatalf("%s: expected an image and a mask ifd", tc.name)
+		}
+		for ti, pix := range decodedTiles(t, ifds[1]) {
+			for i, v := range pix {
+				if (v == 255) != (alpha(i) != 0) || (v != 0 && v != 255) {
+					t.Fatalf("%s: mask tile %d pixel %d is %d", tc.name, ti, i, v)
+				}
+			}
+		}
+		before, after := decodedTiles(t, parseIFDs(t, src)[0]), decodedTiles(t, ifds[0])
+		for i := range before {
+			if !bytes.Equal(before[i], after[i]) {
+				t.Errorf("%s: image tile %d changed", tc.name, i)
+			}
+		}
+	}
+}
+
+func TestBilevelMask(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcIFDs := parseIFDs(t, src)
+	nbits := 0
+	for _, ifd := range srcIFDs {
+		if ifd.SubfileType&subfileTypeMask != 0 && len(ifd.BitsPerSample) == 1 && ifd.BitsPerSample[0] == 1 {
+			nbits++
+		}
+	}
+	if nbits == 0 {
+		t.Fatal("graymask.tif has no 1 bit mask")
+	}
+
+	//packed 1 bit tiles: 16 pixels per 2 bytes
+	img := withTiles(grayIFD(32, 16, 16), []byte("i0"), []byte("i1"))
+	msk := grayIFD(32, 16, 16)
+	msk.BitsPerSample = []uint16{1}
+	msk.PhotometricInterpretation = photometricInterpretationMask
+	packed := [][]byte{}
+	for tx := 0; tx < 2; tx++ {
+		bits := make([]byte, 16*16/8)
+		for i := range bits {
+			bits[i] = byte(0xf0 >> tx)
+		}
+		enc, err := compress(compressionDeflate, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed = append(packed, enc)
+	}
+	msk.Compression = compressionDeflate
+	withTiles(msk, packed...)
+	if err := img.AddMask(msk); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"graymask.tif": src, "synthetic": encodeTIFF(t, img)} {
+		cfg := DefaultConfig()
+		cfg.MaskFromAlpha = true //must not replace existing masks
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(data)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		for i, ifd := range parseIFDs(t, buf.Bytes()) {
+			if ifd.SubfileType&subfileTypeMask != 0 && (len(ifd.BitsPerSample) != 1 || ifd.BitsPerSample[0] != 1) {
+				t.Errorf("%s: mask ifd %d has BitsPerSample %v", name, i, ifd.BitsPerSample)
+			}
+		}
+		eq, diff, err := TilesEqual(bytes.NewReader(data), bytes.NewReader(buf.Bytes()))
+		if err != nil || !eq {
+			t.Errorf("%s: %v %s", name, err, diff)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package cogger
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// metadataItem is an item of the GDAL_METADATA xml
+type metadataItem struct {
+	name, domain, value string
+	sample              int //band index, -1 for dataset items
+}
+
+// AddMetadataDomain returns the GDAL_METADATA xml md with the given items added
+// to the metadata domain, in the format written by gdal's GTiff driver, i.e.
+// <Item name="key" domain="domain">value</Item>. An empty domain is gdal's
+// default domain. md may be empty, and existing items are kept, except those
+// with the same name and domain as a new item which are replaced. It is meant to
+// be called from a Config.MetadataRewriter
+func AddMetadataDomain(md, domain string, items map[string]string) (string, error) {
+	keys := make([]string, 0, len(items))
+	for k := range items {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	mdis := make([]metadataItem, len(keys))
+	for i, k := range keys {
+		mdis[i] = metadataItem{name: k, domain: domain, value: items[k], sample: -1}
+	}
+	return addMetadataItems(md, mdis)
+}
+
+// addMetadataItems returns md with items appended, replacing the items of md
+// with the same name, domain and sample
+func addMetadataItems(md string, items []metadataItem) (string, error) {
+	md, err := removeMetadataItems(md, items)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	attr := func(name, value string) error {
+		buf.WriteString(" " + name + `="`)
+		if err := xml.EscapeText(&buf, []byte(value)); err != nil {
+			return err
+		}
+		buf.WriteString(`"`)
+		return nil
+	}
+	for _, item := range items {
+		buf.WriteString("  <Item")
+		if err := attr("name", item.name); err != nil {
+			return "", err
+		}
+		if item.sample >= 0 {
+			if err := attr("sample", strconv.Itoa(item.sample)); err != nil {
+				return "", err
+			}
+		}
+		if item.domain != "" {
+			if err := attr("domain", item.domain); err != nil {
+				return "", err
+			}
+		}
+		buf.WriteString(">")
+		if err := xml.EscapeText(&buf, []byte(item.value)); err != nil {
+			return "", err
+		}
+		buf.WriteString("</Item>\n")
+	}
+	if md == "" {
+		return "<GDALMetadata>\n" + buf.String() + "</GDALMetadata>\n", nil
+	}
+	end := strings.LastIndex(md, "</GDALMetadata>")
+	if end < 0 {
+		return "", fmt.Errorf("malformed GDAL metadata")
+	}
+	return md[:end] + buf.String() + md[end:], nil
+}
+
+// removeMetadataItems returns md without the items that have the same name,
+// domain and sample as one of items
+func removeMetadataItems(md string, items []metadataItem) (string, error) {
+	type key struct {
+		name, domain string
+		sample       int
+	}
+	remove := make(map[key]bool, len(items))
+	for _, item := range items {
+		remove[key{item.name, item.domain, item.sample}] = true
+	}
+	return editMetadataItems(md, func(item *metadataItem) bool {
+		return !remove[key{item.name, item.domain, item.sample}]
+	})
+}
+
+// remapMetadataSamples returns md with the sample of each band item replaced by
+// samples[sample]. Items whose sample is missing from samples are removed
+func remapMetadataSamples(md string, samples map[int]int) (string, error) {
+	return editMetadataItems(md, func(item *metadataItem) bool {
+		if item.sample < 0 {
+			return true
+		}
+		s, ok := samples[item.sample]
+		item.sample = s
+		return ok
+	})
+}
+
+var sampleAttr = regexp.MustCompile(`\bsample\s*=\s*("[^"]*"|'[^']*')`)
+
+// editMetadataItems calls edit with the name, domain and sample of each item of
+// md (its value is not decoded), and returns md without the items for which it
+// returns false, and with the sample changes made by edit
+func editMetadataItems(md string, edit func(item *metadataItem) bool) (string, error) {
+	out := strings.Builder{}
+	last := 0
+	dec := xml.NewDecoder(strings.NewReader(md))
+	for {
+		start := int(dec.InputOffset())
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("malformed GDAL metadata: %w", err)
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "Item" {
+			continue
+		}
+		tagEnd := int(dec.InputOffset())
+		item := metadataItem{sample: -1}
+		for _, a := range se.Attr {
+			switch a.Name.Local {
+			case "name":
+				item.name = a.Value
+			case "domain":
+				item.domain = a.Value
+			case "sample":
+				if item.sample, err = strconv.Atoi(a.Value); err != nil {
+					return "", fmt.Errorf("malformed GDAL metadata: invalid sample %q", a.Value)
+				}
+			}
+		}
+		if err = dec.Skip(); err != nil {
+			return "", fmt.Errorf("malformed GDAL metadata: %w", err)
+		}
+		sample := item.sample
+		if edit(&item) {
+			if item.sample != sample {
+				tag := sampleAttr.ReplaceAllLiteralString(md[start:tagEnd], `sample="`+strconv.Itoa(item.sample)+`"`)
+				out.WriteString(md[last:start] + tag)
+				last = tagEnd
+			}
+			continue
+		}
+		//also drop the indentation and line break around the item
+		end := int(dec.InputOffset())
+		for start > last && (md[start-1] == ' ' || md[start-1] == '\t') {
+			start--
+		}
+		if end < len(md) && md[end] == '\n' {
+			end++
+		}
+		out.WriteString(md[last:start])
+		last = end
+	}
+	out.WriteString(md[last:])
+	return out.String(), nil
+}
+
+// pamMetadata is a <Metadata> element of a gdal .aux.xml file
+type pamMetadata struct {
+	Domain string `xml:"domain,attr"`
+	Format string `xml:"format,attr"`
+	Items  []struct {
+		Key   string `xml:"key,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"MDI"`
+}
+
+// MergeAuxXML returns the GDAL_METADATA xml md with the metadata of the gdal PAM
+// (.aux.xml) sidecar read from aux added: the dataset and band metadata items of
+// all domains, including band statistics, so that the output does not depend
+// on the sidecar anymore. xml formatted domains (e.g. xml:XMP) are skipped.
+// The nodata value of the first band that has one is returned separately, as it
+// belongs to the GDAL_NODATA tag. See also Config.AuxXML.
+func MergeAuxXML(md string, aux io.Reader) (merged, nodata string, err error) {
+	pam := struct {
+		XMLName  xml.Name      `xml:"PAMDataset"`
+		Metadata []pamMetadata `xml:"Metadata"`
+		Bands    []struct {
+			Band     int           `xml:"band,attr"`
+			NoData   *string       `xml:"NoDataValue"`
+			Metadata []pamMetadata `xml:"Metadata"`
+		} `xml:"PAMRasterBand"`
+	}{}
+	if err = xml.NewDecoder(aux).Decode(&pam); err != nil {
+		return "", "", fmt.Errorf("parse aux.xml: %w", err)
+	}
+	items := []metadataItem{}
+	add := func(mds []pamMetadata, sample int) {
+		for _, m := range mds {
+			if m.Format != "" {
+				continue
+			}
+			for _, mdi := range m.Items {
+				items = append(items, metadataItem{name: mdi.Key, domain: m.Domain, value: mdi.Value, sample: sample})
+			}
+		}
+	}
+	add(pam.Metadata, -1)
+	for _, band := range pam.Bands {
+		if band.Band < 1 {
+			return "", "", fmt.Errorf("parse aux.xml: invalid band %d", band.Band)
+		}
+		add(band.Metadata, band.Band-1)
+		if band.NoData != nil && nodata == "" {
+			nodata = strings.TrimSpace(*band.NoData)
+		}
+	}
+	if len(items) == 0 {
+		return md, nodata, nil
+	}
+	merged, err = addMetadataItems(md, items)
+	return merged, nodata, err
+}
@@ -0,0 +1,207 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/tiff"
+)
+
+func TestMetadataRewriter(t *testing.T) {
+	f, err := os.Open("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cfg := DefaultConfig()
+	cfg.MetadataRewriter = func(level int, mask bool, xml string) (string, error) {
+		if mask {
+			return "", nil
+		}
+		return fmt.Sprintf(`<GDALMetadata><Item name="LEVEL">%d</Item></GDALMetadata>`, level), nil
+	}
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	for i, exp := range []string{"0", "", "1", ""} {
+		if exp != "" {
+			exp = `<GDALMetadata><Item name="LEVEL">` + exp + `</Item></GDALMetadata>`
+		}
+		if ifds[i].GDALMetaData != exp {
+			t.Errorf("ifd %d: got metadata %q", i, ifds[i].GDALMetaData)
+		}
+	}
+
+	cfg.MetadataRewriter = func(level int, mask bool, xml string) (string, error) {
+		return "", fmt.Errorf("failed")
+	}
+	_, _ = f.Seek(0, io.SeekStart)
+	if err := cfg.Rewrite(io.Discard, f); err == nil {
+		t.Error("rewriter error not reported")
+	}
+}
+
+func TestAddMetadataDomain(t *testing.T) {
+	src, err := os.ReadFile("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.MetadataRewriter = func(level int, mask bool, md string) (string, error) {
+		if level > 0 || mask {
+			return md, nil
+		}
+		md, err := AddMetadataDomain(md, "", map[string]string{"AREA": "Toulouse"})
+		if err != nil {
+			return "", err
+		}
+		return AddMetadataDomain(md, "PROCESSING", map[string]string{"VERSION": "1.2", "FILTER": "a<b"})
+	}
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	expected := "<GDALMetadata>\n" +
+		"  <Item name=\"AREA\">Toulouse</Item>\n" +
+		"  <Item name=\"FILTER\" domain=\"PROCESSING\">a&lt;b</Item>\n" +
+		"  <Item name=\"VERSION\" domain=\"PROCESSING\">1.2</Item>\n" +
+		"</GDALMetadata>\n"
+	if md := parseIFDs(t, buf.Bytes())[0].GDALMetaData; md != expected {
+		t.Errorf("unexpected metadata %q", md)
+	}
+	if _, err := AddMetadataDomain("<foo/>", "D", map[string]string{"K": "V"}); err == nil {
+		t.Error("expected an error for malformed metadata")
+	}
+
+	//items with the same name and domain are replaced, other ones are kept
+	md, err := AddMetadataDomain(expected, "PROCESSING", map[string]string{"VERSION": "1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err = AddMetadataDomain(md, "", map[string]string{"VERSION": "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "<GDALMetadata>\n" +
+		"  <Item name=\"AREA\">Toulouse</Item>\n" +
+		"  <Item name=\"FILTER\" domain=\"PROCESSING\">a&lt;b</Item>\n" +
+		"  <Item name=\"VERSION\" domain=\"PROCESSING\">1.3</Item>\n" +
+		"  <Item name=\"VERSION\">2</Item>\n" +
+		"</GDALMetadata>\n"
+	if md != expected {
+		t.Errorf("unexpected overwritten metadata %q", md)
+	}
+}
+
+func TestAuxXML(t *testing.T) {
+	src, err := os.ReadFile("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.AuxXML = []byte(`<PAMDataset>
+  <Metadata>
+    <MDI key="AREA_OR_POINT">Area</MDI>
+  </Metadata>
+  <Metadata domain="xml:XMP" format="xml"><x:xmpmeta/></Metadata>
+  <PAMRasterBand band="1">
+    <NoDataValue>0.000000000000000E+00</NoDataValue>
+    <Metadata>
+      <MDI key="STATISTICS_MAXIMUM">255</MDI>
+      <MDI key="STATISTICS_MEAN">12.5</MDI>
+    </Metadata>
+  </PAMRasterBand>
+</PAMDataset>`)
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	expected := "<GDALMetadata>\n" +
+		"  <Item name=\"AREA_OR_POINT\">Area</Item>\n" +
+		"  <Item name=\"STATISTICS_MAXIMUM\" sample=\"0\">255</Item>\n" +
+		"  <Item name=\"STATISTICS_MEAN\" sample=\"0\">12.5</Item>\n" +
+		"</GDALMetadata>\n"
+	if md := ifds[0].GDALMetaData; md != expected {
+		t.Errorf("unexpected metadata %q", md)
+	}
+	if nd := strings.TrimRight(ifds[0].NoData, "\x00"); nd != "0.000000000000000E+00" {
+		t.Errorf("unexpected nodata %q", nd)
+	}
+	if len(ifds) > 1 && ifds[1].GDALMetaData != "" {
+		t.Errorf("overview metadata should be untouched, got %q", ifds[1].GDALMetaData)
+	}
+
+	cfg.AuxXML = []byte("<PAMDataset><PAMRasterBand band=\"0\"/></PAMDataset>")
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+		t.Error("expected an error for an invalid band")
+	}
+	cfg.AuxXML = []byte("<VRTDataset/>")
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(src)); err == nil {
+		t.Error("expected an error for a non PAM document")
+	}
+}
+
+// rawNoData returns the bytes of the GDAL_NODATA tag of each ifd of the tiff
+// encoded in data, including their terminating NUL
+func rawNoData(t *testing.T, data []byte) []string {
+	t.Helper()
+	tif, err := tiff.Parse(bytes.NewReader(data), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []string{}
+	for _, tifd := range tif.IFDs() {
+		value := ""
+		if tifd.HasField(42113) {
+			f := tifd.GetField(42113)
+			value = string(f.Value().Bytes()[:f.Count()])
+		}
+		values = append(values, value)
+	}
+	return values
+}
+
+func TestNoData(t *testing.T) {
+	source := func(nodata string) []byte {
+		img := withTiles(grayIFD(32, 32, 16), make([]byte, 256), make([]byte, 256), make([]byte, 256), make([]byte, 256))
+		ovr := withTiles(grayIFD(16, 16, 16), make([]byte, 256))
+		img.NoData, ovr.NoData = nodata, nodata
+		return encodeTIFF(t, withOverviews(img, ovr))
+	}
+	//gdal quirks such as trailing spaces must survive a rewrite byte for byte
+	for _, nodata := range []string{"-9999 ", "0", "nan  "} {
+		src := source(nodata)
+		buf := bytes.Buffer{}
+		if err := Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		in, out := rawNoData(t, src), rawNoData(t, buf.Bytes())
+		if len(out) != 2 || out[0] != nodata+"\x00" || out[1] != in[1] {
+			t.Errorf("nodata %q: got %q from %q", nodata, out, in)
+		}
+	}
+
+	cfg := DefaultConfig()
+	for _, tc := range []struct{ value, expected string }{
+		{" 255 ", "255\x00"},
+		{"", ""},
+	} {
+		cfg.NoData = &tc.value
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(source("-9999 "))); err != nil {
+			t.Fatal(err)
+		}
+		for i, nodata := range rawNoData(t, buf.Bytes()) {
+			if nodata != tc.expected {
+				t.Errorf("override %q: ifd %d has nodata %q, expected %q", tc.value, i, nodata, tc.expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package cogger
+
+import (
+	"context"
+	"io"
+)
+
+type progressWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	onBytes func(int64)
+	total   int64
+}
+
+// NewProgressWriter wraps w so that onBytes is called with the cumulative number
+// of bytes written after each write, and so that writes fail with ctx.Err() once
+// ctx is done. Passing the result to Rewrite allows reporting its progress and
+// cancelling it. onBytes may be nil.
+func NewProgressWriter(ctx context.Context, w io.Writer, onBytes func(int64)) io.Writer {
+	return &progressWriter{w: w, ctx: ctx, onBytes: onBytes}
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	if err := pw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := pw.w.Write(p)
+	pw.total += int64(n)
+	if pw.onBytes != nil {
+		pw.onBytes(pw.total)
+	}
+	return n, err
+}
@@ -0,0 +1,46 @@
+package cogger
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestProgressWriter(t *testing.T) {
+	src, err := os.ReadFile("testdata/graymask.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := bytes.Buffer{}
+	if err := Rewrite(&ref, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	last := int64(0)
+	buf := bytes.Buffer{}
+	w := NewProgressWriter(context.Background(), &buf, func(n int64) {
+		if n < last {
+			t.Errorf("progress went back from %d to %d", last, n)
+		}
+		last = n
+	})
+	if err := Rewrite(w, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	if last != int64(ref.Len()) || !bytes.Equal(buf.Bytes(), ref.Bytes()) {
+		t.Errorf("reported %d bytes, wrote %d, expected %d", last, buf.Len(), ref.Len())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w = NewProgressWriter(ctx, io.Discard, func(n int64) {
+		if n > 1000 {
+			cancel()
+		}
+	})
+	err = Rewrite(w, bytes.NewReader(src))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancellation error, got %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/tiff"
+)
+
+// retile changes the tile size of ifd to tw x th. Tiles are decoded and
+// assembled one row of output tiles at a time, and the new tiles are compressed
+// again and kept in memory. Output tiles that only cover sparse input tiles are
+// left sparse.
+func (ifd *ifd) retile(tw, th int) error {
+	if tw <= 0 || tw%16 != 0 || tw > 0xffff || th <= 0 || th%16 != 0 || th > 0xffff {
+		return fmt.Errorf("invalid tile size %dx%d: must be a multiple of 16", tw, th)
+	}
+	if tw == int(ifd.TileWidth) && th == int(ifd.TileLength) {
+		return nil
+	}
+	switch ifd.Compression {
+	case compressionNone, compressionLZW, compressionDeflate, compressionAdobeDeflate:
+	default:
+		return fmt.Errorf("unsupported compression %d", ifd.Compression)
+	}
+	if ifd.Predictor > 1 {
+		//differencing restarts at each tile row, and would have to be redone
+		return fmt.Errorf("unsupported predictor %d", ifd.Predictor)
+	}
+	//bit packed samples (e.g. 1 bit masks) are supported as long as tile rows
+	//span whole bytes, which holds for the tile widths required by tiff
+	bits := 0
+	for _, bps := range ifd.BitsPerSample {
+		bits += int(bps)
+	}
+	if ifd.planarConfiguration() == planarConfigurationSeparate && len(ifd.BitsPerSample) > 0 {
+		bits = int(ifd.BitsPerSample[0])
+	}
+	otw, oth := int(ifd.TileWidth), int(ifd.TileLength)
+	if bits == 0 || otw*bits%8 != 0 {
+		return fmt.Errorf("unsupported BitsPerSample %v", ifd.BitsPerSample)
+	}
+	//row returns the size in bytes of w pixels
+	row := func(w int) int { return w * bits / 8 }
+
+	ontx := (int(ifd.ImageWidth) + otw - 1) / otw
+	onty := (int(ifd.ImageLength) + oth - 1) / oth
+	ntx := (int(ifd.ImageWidth) + tw - 1) / tw
+	nty := (int(ifd.ImageLength) + th - 1) / th
+	nplanes := ifd.planeCount()
+
+	data := []byte{}
+	offsets := make([]uint64, ntx*nty*nplanes)
+	counts := make([]uint32, ntx*nty*nplanes)
+	stride := row(ontx * otw) //size of a row of the decoded input tiles
+	otile := make([]byte, row(otw)*oth)
+	ntile := make([]byte, row(tw)*th)
+	for p := 0; p < nplanes; p++ {
+		for ny := 0; ny < nty; ny++ {
+			//decode the input tile rows covering this row of output tiles
+			r0 := ny * th / oth
+			r1 := ((ny+1)*th - 1) / oth
+			if r1 >= onty {
+				r1 = onty - 1
+			}
+			strip := make([]byte, (r1-r0+1)*oth*stride)
+			sparse := make([]bool, (r1-r0+1)*ontx)
+			for oy := r0; oy <= r1; oy++ {
+				for ox := 0; ox < ontx; ox++ {
+					idx := p*ontx*onty + oy*ontx + ox
+					bc := int(ifd.TileByteCounts[idx])
+					if bc == 0 {
+						sparse[(oy-r0)*ontx+ox] = true
+						continue
+					}
+					tile := make([]byte, bc)
+					if n, err := ifd.r.ReadAt(tile, int64(ifd.OriginalTileOffsets[idx])); n < bc {
+						return fmt.Errorf("read tile %d: %w", idx, err)
+					}
+					pix, err := decompress(ifd.Compression, tile, len(otile))
+					if err != nil {
+						return fmt.Errorf("tile %d: %w", idx, err)
+					}
+					for y := 0; y < oth; y++ {
+						start := ((oy-r0)*oth+y)*stride + row(ox*otw)
+						copy(strip[start:start+row(otw)], pix[y*row(otw):(y+1)*row(otw)])
+					}
+				}
+			}
+			for nx := 0; nx < ntx; nx++ {
+				//skip output tiles whose covered input tiles are all sparse
+				empty := true
+				for oy := r0; oy <= r1 && empty; oy++ {
+					for ox := nx * tw / otw; ox < ontx && ox*otw < (nx+1)*tw; ox++ {
+						if !sparse[(oy-r0)*ontx+ox] {
+							empty = false
+							break
+						}
+					}
+				}
+				if empty {
+					continue
+				}
+				for i := range ntile {
+					ntile[i] = 0
+				}
+				for y := 0; y < th; y++ {
+					sy := ny*th + y - r0*oth
+					if sy >= (r1-r0+1)*oth {
+						break
+					}
+					x0 := row(nx * tw)
+					if x0 >= stride {
+						break
+					}
+					copy(ntile[y*row(tw):(y+1)*row(tw)], strip[sy*stride+x0:(sy+1)*stride])
+				}
+				enc, err := compress(ifd.Compression, ntile)
+				if err != nil {
+					return fmt.Errorf("tile %d,%d: %w", nx, ny, err)
+				}
+				idx := p*ntx*nty + ny*ntx + nx
+				offsets[idx] = uint64(len(data))
+				counts[idx] = uint32(len(enc))
+				data = append(data, enc...)
+			}
+		}
+	}
+	ifd.TileWidth, ifd.TileLength = uint16(tw), uint16(th)
+	ifd.OriginalTileOffsets = offsets
+	ifd.TileByteCounts = counts
+	ifd.r = tiff.NewBReader(bytes.NewReader(data), ifd.r.ByteOrder())
+	ifd.inMemory = true
+	return nil
+}
@@ -0,0 +1,136 @@
+package cogger
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRetile(t *testing.T) {
+	tiles := [][]byte{}
+	for i := 0; i < 3*3; i++ {
+		tile := make([]byte, 256*256)
+		for p := range tile {
+			tile[p] = byte(i*7 + p%251)
+		}
+		if i == 4 {
+			tile = nil //sparse
+		}
+		tiles = append(tiles, tile)
+	}
+	synth := encodeTIFF(t, withTiles(grayIFD(600, 520, 256), tiles...))
+	band4, err := os.ReadFile("testdata/band4.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		src    []byte
+		tw, th int
+	}{
+		{"synthetic", synth, 512, 512},
+		{"synthetic", synth, 128, 64},
+		{"band4.tif", band4, 256, 256},
+		{"band4.tif", band4, 64, 64},
+	} {
+		cfg := DefaultConfig()
+		cfg.Retile = [2]int{tc.tw, tc.th}
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(tc.src)); err != nil {
+			t.Fatalf("%s %dx%d: %v", tc.name, tc.tw, tc.th, err)
+		}
+		in, out := parseIFDs(t, tc.src), parseIFDs(t, buf.Bytes())
+		sortIFDs(in)
+		for i := range in {
+			if int(out[i].TileWidth) != tc.tw || int(out[i].TileLength) != tc.th {
+				t.Fatalf("%s ifd %d: tile size %dx%d", tc.name, i, out[i].TileWidth, out[i].TileLength)
+			}
+			for p := 0; p < in[i].planeCount(); p++ {
+				if !bytes.Equal(planePixels(t, in[i], p), planePixels(t, out[i], p)) {
+					t.Errorf("%s %dx%d ifd %d plane %d: pixels differ", tc.name, tc.tw, tc.th, i, p)
+				}
+			}
+		}
+	}
+
+	//the center 256x256 tile of a 3x3 grid is still sparse when split in 128x128 tiles
+	cfg := DefaultConfig()
+	cfg.Retile = [2]int{128, 128}
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(synth)); err != nil {
+		t.Fatal(err)
+	}
+	out := parseIFDs(t, buf.Bytes())[0]
+	for _, idx := range []int{2*5 + 2, 2*5 + 3, 3*5 + 2, 3*5 + 3} {
+		if out.TileByteCounts[idx] != 0 {
+			t.Errorf("tile %d is not sparse", idx)
+		}
+	}
+
+	cfg.Retile = [2]int{100, 100}
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(synth)); err == nil {
+		t.Error("expected an error for a tile size that is not a multiple of 16")
+	}
+}
+
+func TestRetileBitMask(t *testing.T) {
+	//64x48 gray image with a 1 bit mask, in 32x32 tiles
+	img := withTiles(grayIFD(64, 48, 32), make([]byte, 32*32), make([]byte, 32*32), make([]byte, 32*32), make([]byte, 32*32))
+	tiles := [][]byte{}
+	for i := 0; i < 4; i++ {
+		tile := make([]byte, 32*32/8)
+		for p := range tile {
+			tile[p] = byte(i*31 + p*7)
+		}
+		tiles = append(tiles, tile)
+	}
+	msk := withTiles(grayIFD(64, 48, 32), tiles...)
+	msk.SubfileType = subfileTypeMask
+	msk.BitsPerSample = []uint16{1}
+	msk.PhotometricInterpretation = photometricInterpretationMask
+	img.masks = []*ifd{msk}
+	src := encodeTIFF(t, img)
+
+	//bits returns the mask value of each pixel
+	bits := func(ifd *ifd) []bool {
+		tw, th := int(ifd.TileWidth), int(ifd.TileLength)
+		ntx := (64 + tw - 1) / tw
+		px := make([]bool, 64*48)
+		for idx := range ifd.TileByteCounts {
+			pix, err := decompress(ifd.Compression, rawTile(t, ifd, idx), tw*th/8)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for y := 0; y < th; y++ {
+				for x := 0; x < tw; x++ {
+					ix, iy := idx%ntx*tw+x, idx/ntx*th+y
+					if ix < 64 && iy < 48 {
+						px[iy*64+ix] = pix[(y*tw+x)/8]&(0x80>>uint(x%8)) != 0
+					}
+				}
+			}
+		}
+		return px
+	}
+	exp := bits(parseIFDs(t, src)[1])
+	for _, size := range []int{16, 64} {
+		cfg := DefaultConfig()
+		cfg.Retile = [2]int{size, size}
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatalf("%dx%d: %v", size, size, err)
+		}
+		out := parseIFDs(t, buf.Bytes())[1]
+		if out.BitsPerSample[0] != 1 || int(out.TileWidth) != size {
+			t.Fatalf("%dx%d: got %d bit %dx%d tiles", size, size, out.BitsPerSample[0], out.TileWidth, out.TileLength)
+		}
+		got := bits(out)
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Errorf("%dx%d: pixel %d,%d differs", size, size, i%64, i/64)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package cogger
+
+// TileErrorAction is the way a rewrite proceeds after the data of a tile could
+// not be read, as returned by Config.OnTileError
+type TileErrorAction int
+
+const (
+	// Abort fails the rewrite with the read error
+	Abort TileErrorAction = iota
+	// SkipAsSparse writes the tile as sparse (i.e. with a zero offset and byte
+	// count), which readers render as nodata or zero
+	SkipAsSparse
+	// WriteZeros writes zeros in place of the tile data, keeping its size. The
+	// tile cannot be decoded anymore, but the layout of the file is preserved
+	WriteZeros
+)
+
+// tileError returns the action to take after the data of t could not be read
+func (cog *cog) tileError(t tile, err error) TileErrorAction {
+	if cog.cfg.OnTileError == nil {
+		return Abort
+	}
+	level, plane := 0, int(t.plane)
+	for lvl := cog.ifd; lvl != nil && lvl != t.ifd; lvl = lvl.overview {
+		mask := -1
+		for m, msk := range lvl.masks {
+			if msk == t.ifd {
+				mask = m
+			}
+		}
+		if mask >= 0 {
+			//masks are numbered after the image planes, as in PlanarInterleaving
+			plane = lvl.planeCount() + mask
+			break
+		}
+		level++
+	}
+	return cog.cfg.OnTileError(level, plane, int(t.x), int(t.y), err)
+}
+
+// readTile reads the data of t into buf, which must be TileByteCounts long, as
+// it is written to the output: zeros for the tiles that were recorded as
+// unreadable with WriteZeros, and zeros in place of the tiles whose read fails
+// once their offsets have been written, unless OnTileError aborts
+func (cog *cog) readTile(t tile, buf []byte) error {
+	if t.ifd.zeroed[t.idx] {
+		zero(buf)
+		return nil
+	}
+	if err := cog.loadTile(t.ifd, t.idx, buf); err != nil {
+		if cog.tileError(t, err) == Abort {
+			return err
+		}
+		//the tile offsets have already been written: the tile can no longer be made sparse
+		zero(buf)
+	}
+	return nil
+}
+
+// zero sets all the bytes of buf to 0
+func zero(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
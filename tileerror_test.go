@@ -0,0 +1,130 @@
+package cogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestOnTileError(t *testing.T) {
+	img := withTiles(grayIFD(512, 256, 256), []byte("image0"), []byte("image1"))
+	msk := grayIFD(512, 256, 256)
+	msk.BitsPerSample = []uint16{1}
+	msk.PhotometricInterpretation = photometricInterpretationMask
+	withTiles(msk, []byte("mask0"), []byte("mask1"))
+	if err := img.AddMask(msk); err != nil {
+		t.Fatal(err)
+	}
+	src := encodeTIFF(t, img)
+	in := parseIFDs(t, src)
+
+	type call struct{ level, plane, x, y int }
+	rewrite := func(bad int64, okReads int, action TileErrorAction) ([]*ifd, []call, error) {
+		calls := []call{}
+		cfg := DefaultConfig()
+		cfg.OnTileError = func(level, plane, x, y int, err error) TileErrorAction {
+			calls = append(calls, call{level, plane, x, y})
+			return action
+		}
+		buf := bytes.Buffer{}
+		err := cfg.Rewrite(&buf, &failingReader{bytes.NewReader(src), bad, okReads})
+		if err != nil {
+			return nil, calls, err
+		}
+		return parseIFDs(t, buf.Bytes()), calls, nil
+	}
+
+	bad := int64(in[0].OriginalTileOffsets[1])
+	if err := Rewrite(io.Discard, &failingReader{bytes.NewReader(src), bad, 0}); err == nil {
+		t.Error("expected an error without OnTileError")
+	}
+	if _, calls, err := rewrite(bad, 0, Abort); err == nil || len(calls) != 1 || calls[0] != (call{0, 0, 1, 0}) {
+		t.Errorf("abort: got %v with calls %v", err, calls)
+	}
+
+	ifds, calls, err := rewrite(bad, 0, SkipAsSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 {
+		t.Errorf("skip: got calls %v", calls)
+	}
+	if ifds[0].TileByteCounts[1] != 0 || ifds[0].OriginalTileOffsets[1] != 0 || string(rawTile(t, ifds[0], 0)) != "image0" {
+		t.Error("skip: tile 1 not written as sparse")
+	}
+
+	//an unreadable mask tile is reported after the image planes
+	ifds, calls, err = rewrite(int64(in[1].OriginalTileOffsets[1]), 0, WriteZeros)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != (call{0, 1, 1, 0}) {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	if !bytes.Equal(rawTile(t, ifds[1], 1), make([]byte, 5)) || string(rawTile(t, ifds[1], 0)) != "mask0" {
+		t.Error("zeros: mask tile 1 not replaced by zeros")
+	}
+
+	//the status of the tile is reused when deduplicating
+	for _, action := range []TileErrorAction{SkipAsSparse, WriteZeros} {
+		calls := 0
+		cfg := DefaultConfig()
+		cfg.DedupeTiles = true
+		cfg.OnTileError = func(level, plane, x, y int, err error) TileErrorAction {
+			calls++
+			return action
+		}
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, &failingReader{bytes.NewReader(src), bad, 0}); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 1 {
+			t.Errorf("action %d: OnTileError called %d times", action, calls)
+		}
+	}
+
+	//Layout yields the same tile data as Rewrite
+	for _, action := range []TileErrorAction{SkipAsSparse, WriteZeros} {
+		cfg := DefaultConfig()
+		cfg.OnTileError = func(level, plane, x, y int, err error) TileErrorAction {
+			return action
+		}
+		ref := bytes.Buffer{}
+		if err := cfg.Rewrite(&ref, &failingReader{bytes.NewReader(src), bad, 0}); err != nil {
+			t.Fatal(err)
+		}
+		out := bytes.Buffer{}
+		seq, err := cfg.Layout(&out, &failingReader{bytes.NewReader(src), bad, 0})
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq(func(tile TileRef) bool {
+			data := make([]byte, tile.Size)
+			if err := tile.ReadData(data); err != nil {
+				t.Fatal(err)
+			}
+			leader := make([]byte, 4)
+			binary.LittleEndian.PutUint32(leader, uint32(tile.Size))
+			out.Write(leader)
+			out.Write(data)
+			out.Write(data[len(data)-4:])
+			return true
+		})
+		if !bytes.Equal(out.Bytes(), ref.Bytes()) {
+			t.Errorf("action %d: layout output differs from Rewrite", action)
+		}
+	}
+
+	//the tile can no longer be made sparse when the read fails while it is written
+	ifds, calls, err = rewrite(bad, 1, SkipAsSparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || !bytes.Equal(rawTile(t, ifds[0], 1), make([]byte, 6)) {
+		t.Errorf("late failure: got tile %q after calls %v", rawTile(t, ifds[0], 1), calls)
+	}
+	if _, _, err := rewrite(bad, 1, Abort); err == nil {
+		t.Error("late failure: expected an error")
+	}
+}
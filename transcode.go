@@ -0,0 +1,313 @@
+package cogger
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strconv"
+)
+
+// Compression is a tiff compression scheme, as stored in the Compression tag
+type Compression uint16
+
+const (
+	CompressionNone    Compression = compressionNone
+	CompressionLZW     Compression = compressionLZW
+	CompressionJPEG    Compression = compressionJPEG
+	CompressionDeflate Compression = compressionDeflate
+)
+
+// compressionNames holds the gdal names of the known tiff compression schemes
+var compressionNames = map[Compression]string{
+	compressionNone:         "NONE",
+	compressionLZW:          "LZW",
+	compressionJPEG:         "JPEG",
+	compressionDeflate:      "DEFLATE",
+	compressionAdobeDeflate: "DEFLATE",
+	compressionLERC:         "LERC",
+	compressionLZMA:         "LZMA",
+	compressionZSTD:         "ZSTD",
+	compressionWEBP:         "WEBP",
+	compressionJXL:          "JXL",
+}
+
+// String returns the name of c as used by gdal (e.g. "DEFLATE"), or its numeric
+// value for unknown schemes
+func (c Compression) String() string {
+	if name, ok := compressionNames[c]; ok {
+		return name
+	}
+	return strconv.Itoa(int(c))
+}
+
+// CompressionName returns the name of the tiff compression code c, for logging
+func CompressionName(c uint16) string {
+	return Compression(c).String()
+}
+
+// Transcode registers that tiles compressed with from must be decoded and
+// compressed again with to, e.g. to produce lossless archival copies of JPEG
+// cogs. Transcoded tiles are kept in memory, and decoding JPEG tiles is
+// expensive.
+//
+// Supported sources are None, LZW, Deflate and JPEG; supported targets are None,
+// LZW and Deflate. JPEG tiles must be 8 bit; YCbCr tiles are converted to RGB.
+func (cfg *Config) Transcode(from, to Compression) {
+	if cfg.Transcodings == nil {
+		cfg.Transcodings = make(map[Compression]Compression)
+	}
+	cfg.Transcodings[from] = to
+}
+
+// transcode recompresses the tiles of ifd with the given compression
+func (ifd *ifd) transcode(to Compression) error {
+	switch to {
+	case CompressionNone, CompressionLZW, CompressionDeflate:
+	default:
+		return fmt.Errorf("unsupported target compression %d", to)
+	}
+	from := Compression(ifd.Compression)
+	if from == to {
+		return nil
+	}
+	if from == CompressionJPEG {
+		return ifd.transcodeJPEG(to)
+	}
+	size := int(ifd.TileWidth) * int(ifd.TileLength) * ifd.pixelSize()
+	if size == 0 {
+		return fmt.Errorf("unsupported BitsPerSample %v", ifd.BitsPerSample)
+	}
+	//readers ignore the predictor of uncompressed tiles: it must be undone
+	undo := to == CompressionNone && ifd.Predictor > predictorNone
+	nsamples := int(ifd.SamplesPerPixel)
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
+		nsamples = 1
+	}
+	if undo {
+		if ifd.Predictor != predictorHorizontal {
+			return fmt.Errorf("unsupported predictor %d for uncompressed tiles", ifd.Predictor)
+		}
+		for _, bps := range ifd.BitsPerSample {
+			if bps != ifd.BitsPerSample[0] {
+				return fmt.Errorf("unsupported BitsPerSample %v with the horizontal predictor", ifd.BitsPerSample)
+			}
+		}
+	}
+	err := ifd.transcodeTiles(func(idx int, tile []byte) ([]byte, error) {
+		pix, err := decompress(ifd.Compression, tile, size)
+		if err != nil {
+			return nil, err
+		}
+		if undo {
+			err = undoHorizontalPredictor(pix, int(ifd.TileWidth), nsamples, int(ifd.BitsPerSample[0])/8, ifd.r.ByteOrder())
+			if err != nil {
+				return nil, err
+			}
+		}
+		return compress(uint16(to), pix)
+	})
+	if err != nil {
+		return err
+	}
+	ifd.Compression = uint16(to)
+	if undo {
+		ifd.Predictor = 0
+	}
+	return nil
+}
+
+// pixelSize returns the number of bytes used by a pixel of a decoded tile, or 0
+// if samples are not byte aligned
+func (ifd *ifd) pixelSize() int {
+	bits := 0
+	for _, bps := range ifd.BitsPerSample {
+		if bps%8 != 0 {
+			return 0
+		}
+		bits += int(bps)
+	}
+	if ifd.planarConfiguration() == planarConfigurationSeparate && len(ifd.BitsPerSample) > 0 {
+		bits = int(ifd.BitsPerSample[0])
+	}
+	return bits / 8
+}
+
+func (ifd *ifd) transcodeJPEG(to Compression) error {
+	for _, bps := range ifd.BitsPerSample {
+		if bps != 8 {
+			return fmt.Errorf("unsupported jpeg BitsPerSample %v", ifd.BitsPerSample)
+		}
+	}
+	nsamples := int(ifd.SamplesPerPixel)
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
+		nsamples = 1
+	}
+	tw, th := int(ifd.TileWidth), int(ifd.TileLength)
+	err := ifd.transcodeTiles(func(idx int, tile []byte) ([]byte, error) {
+		img, err := jpeg.Decode(bytes.NewReader(inlineJPEGTables(ifd.JPEGTables, tile)))
+		if err != nil {
+			return nil, fmt.Errorf("jpeg: %w", err)
+		}
+		b := img.Bounds()
+		if b.Dx() != tw || b.Dy() != th {
+			return nil, fmt.Errorf("jpeg: decoded %dx%d, expected %dx%d", b.Dx(), b.Dy(), tw, th)
+		}
+		pix := make([]byte, 0, tw*th*nsamples)
+		switch img := img.(type) {
+		case *image.Gray:
+			if nsamples != 1 {
+				return nil, fmt.Errorf("jpeg: got 1 band, expected %d", nsamples)
+			}
+			for y := 0; y < th; y++ {
+				pix = append(pix, img.Pix[y*img.Stride:y*img.Stride+tw]...)
+			}
+		case *image.YCbCr, *image.RGBA:
+			if nsamples != 3 {
+				return nil, fmt.Errorf("jpeg: got 3 bands, expected %d", nsamples)
+			}
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+					pix = append(pix, c.R, c.G, c.B)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("jpeg: unsupported color model %T", img)
+		}
+		return compress(uint16(to), pix)
+	})
+	if err != nil {
+		return err
+	}
+	ifd.Compression = uint16(to)
+	ifd.JPEGTables = nil
+	ifd.Predictor = 0
+	if ifd.PhotometricInterpretation == photometricInterpretationYCbCr {
+		ifd.PhotometricInterpretation = photometricInterpretationRGB
+	}
+	return nil
+}
+
+// inlineJPEGTables returns the abbreviated jpeg stream tile with the tables
+// prepended, minus their SOI/EOI markers, making it decodable on its own
+func inlineJPEGTables(tables, tile []byte) []byte {
+	if len(tables) <= 4 || len(tile) <= 2 {
+		return tile
+	}
+	full := make([]byte, 0, len(tables)+len(tile))
+	full = append(full, tables[:len(tables)-2]...)
+	return append(full, tile[2:]...)
+}
+
+// inlineJPEGTables makes each tile of a jpeg ifd a standalone jpeg stream, and
+// removes its JPEGTables tag
+func (ifd *ifd) inlineJPEGTables() error {
+	if ifd.Compression != compressionJPEG || len(ifd.JPEGTables) == 0 {
+		return nil
+	}
+	err := ifd.transcodeTiles(func(idx int, tile []byte) ([]byte, error) {
+		return inlineJPEGTables(ifd.JPEGTables, tile), nil
+	})
+	if err != nil {
+		return err
+	}
+	ifd.JPEGTables = nil
+	return nil
+}
+
+// scaleTo8Bit converts the 16 bit unsigned samples of ifd to 8 bit ones with
+// fn, which is called with the band of each sample
+func (ifd *ifd) scaleTo8Bit(fn func(band int, v uint16) uint8) error {
+	for _, bps := range ifd.BitsPerSample {
+		if bps != 16 {
+			return fmt.Errorf("unsupported BitsPerSample %v", ifd.BitsPerSample)
+		}
+	}
+	for _, sf := range ifd.SampleFormat {
+		if sf != sampleFormatUInt {
+			return fmt.Errorf("unsupported SampleFormat %v", ifd.SampleFormat)
+		}
+	}
+	if ifd.Predictor > 1 {
+		return fmt.Errorf("unsupported predictor %d", ifd.Predictor)
+	}
+	switch ifd.Compression {
+	case compressionNone, compressionLZW, compressionDeflate, compressionAdobeDeflate:
+	default:
+		return fmt.Errorf("unsupported compression %d", ifd.Compression)
+	}
+	nsamples := int(ifd.SamplesPerPixel)
+	ntiles := len(ifd.TileByteCounts)
+	if ifd.planarConfiguration() == planarConfigurationSeparate {
+		nsamples = 1
+		ntiles /= int(ifd.SamplesPerPixel)
+	}
+	size := int(ifd.TileWidth) * int(ifd.TileLength) * nsamples
+	order := ifd.r.ByteOrder()
+	err := ifd.transcodeTiles(func(idx int, tile []byte) ([]byte, error) {
+		pix, err := decompress(ifd.Compression, tile, size*2)
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, size)
+		for i := range out {
+			band := i % nsamples
+			if nsamples == 1 {
+				band = idx / ntiles
+			}
+			out[i] = fn(band, order.Uint16(pix[i*2:]))
+		}
+		return compress(ifd.Compression, out)
+	})
+	if err != nil {
+		return err
+	}
+	for i := range ifd.BitsPerSample {
+		ifd.BitsPerSample[i] = 8
+	}
+	ifd.MinSampleValue = nil
+	ifd.MaxSampleValue = nil
+	return nil
+}
+
+// jpegHasTables returns true if the jpeg stream defines a quantization table
+// before its first scan, i.e. does not rely on JPEGTables to be decoded
+func jpegHasTables(stream []byte) bool {
+	for i := 2; i+4 <= len(stream); {
+		if stream[i] != 0xff {
+			return false
+		}
+		switch stream[i+1] {
+		case 0xdb: //DQT
+			return true
+		case 0xda: //SOS
+			return false
+		}
+		i += 2 + (int(stream[i+2])<<8 | int(stream[i+3]))
+	}
+	return false
+}
+
+// checkJPEGTables returns an error if ifd is jpeg compressed, has no JPEGTables,
+// and its first tile has no quantization tables
+func (ifd *ifd) checkJPEGTables() error {
+	if ifd.Compression != compressionJPEG || len(ifd.JPEGTables) > 0 {
+		return nil
+	}
+	for idx, bc := range ifd.TileByteCounts {
+		if bc == 0 {
+			continue
+		}
+		tile := make([]byte, bc)
+		if n, err := ifd.r.ReadAt(tile, int64(ifd.OriginalTileOffsets[idx])); n < len(tile) {
+			return fmt.Errorf("read tile %d: %w", idx, err)
+		}
+		if !jpegHasTables(tile) {
+			return fmt.Errorf("jpeg tile %d has no quantization tables and there is no JPEGTables tag", idx)
+		}
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package cogger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestCompressionName(t *testing.T) {
+	for _, tc := range []struct {
+		code uint16
+		name string
+	}{
+		{1, "NONE"},
+		{5, "LZW"},
+		{7, "JPEG"},
+		{8, "DEFLATE"},
+		{32946, "DEFLATE"},
+		{34887, "LERC"},
+		{34925, "LZMA"},
+		{50000, "ZSTD"},
+		{50001, "WEBP"},
+		{50002, "JXL"},
+		{12345, "12345"},
+	} {
+		if name := CompressionName(tc.code); name != tc.name {
+			t.Errorf("compression %d: got %q, expected %q", tc.code, name, tc.name)
+		}
+	}
+}
+
+func TestTranscodeLossless(t *testing.T) {
+	src, err := os.ReadFile("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Transcode(CompressionLZW, CompressionDeflate)
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	before := parseIFDs(t, src)
+	after := parseIFDs(t, buf.Bytes())
+	if len(before) != len(after) {
+		t.Fatalf("got %d ifds, expected %d", len(after), len(before))
+	}
+	for i := range after {
+		if after[i].Compression != compressionDeflate {
+			t.Errorf("ifd %d: compression %d", i, after[i].Compression)
+		}
+		b, a := decodedTiles(t, before[i]), decodedTiles(t, after[i])
+		for j := range b {
+			if !bytes.Equal(a[j], b[j]) {
+				t.Errorf("ifd %d tile %d: pixels differ", i, j)
+			}
+		}
+	}
+}
+
+func TestTranscodePredictorToNone(t *testing.T) {
+	for _, bps := range []uint16{8, 16} {
+		size := int(bps) / 8
+		//2 samples per pixel, differenced along each row as libtiff does
+		pix := make([]byte, 16*16*2*size)
+		for i := 0; i < 16*16*2; i++ {
+			v := uint16(i*7919 + i/32)
+			if size == 1 {
+				pix[i] = byte(v)
+			} else {
+				binary.LittleEndian.PutUint16(pix[2*i:], v)
+			}
+		}
+		diff := append([]byte{}, pix...)
+		for i := 16*16*2 - 1; i >= 0; i-- {
+			if i%32 < 2 {
+				continue
+			}
+			if size == 1 {
+				diff[i] -= pix[i-2]
+			} else {
+				binary.LittleEndian.PutUint16(diff[2*i:], binary.LittleEndian.Uint16(pix[2*i:])-binary.LittleEndian.Uint16(pix[2*i-4:]))
+			}
+		}
+		img := grayIFD(16, 16, 16)
+		img.SamplesPerPixel = 2
+		img.BitsPerSample = []uint16{bps, bps}
+		img.SampleFormat = []uint16{1, 1}
+		img.ExtraSamples = []uint16{extraSamplesUnassAlpha}
+		img.Compression = compressionLZW
+		img.Predictor = predictorHorizontal
+		src := encodeTIFF(t, withTiles(img, lzwEncode(diff)))
+
+		cfg := DefaultConfig()
+		cfg.Transcode(CompressionLZW, CompressionNone)
+		buf := bytes.Buffer{}
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		out := parseIFDs(t, buf.Bytes())[0]
+		if out.Compression != compressionNone || out.Predictor != 0 {
+			t.Errorf("%d bit: compression %d and predictor %d", bps, out.Compression, out.Predictor)
+		}
+		if !bytes.Equal(rawTile(t, out, 0), pix) {
+			t.Errorf("%d bit: differencing not undone", bps)
+		}
+
+		//the predictor is kept when the target is compressed
+		cfg = DefaultConfig()
+		cfg.Transcode(CompressionLZW, CompressionDeflate)
+		buf.Reset()
+		if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+			t.Fatal(err)
+		}
+		if p := parseIFDs(t, buf.Bytes())[0].Predictor; p != predictorHorizontal {
+			t.Errorf("%d bit: predictor %d after transcoding to deflate", bps, p)
+		}
+	}
+
+	img := withTiles(grayIFD(16, 16, 16), lzwEncode(make([]byte, 16*16*4)))
+	img.BitsPerSample = []uint16{32}
+	img.SampleFormat = []uint16{sampleFormatIEEEFP}
+	img.Compression = compressionLZW
+	img.Predictor = predictorFloatingPoint
+	cfg := DefaultConfig()
+	cfg.Transcode(CompressionLZW, CompressionNone)
+	if err := cfg.Rewrite(io.Discard, bytes.NewReader(encodeTIFF(t, img))); err == nil {
+		t.Error("expected an error for the floating point predictor")
+	}
+}
+
+func TestTranscodeJPEG(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for y := 0; y < 256; y++ {
+		for x := 0; x < 256; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	enc := bytes.Buffer{}
+	if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	//move the quantization tables to JPEGTables, as libtiff does
+	stream := enc.Bytes()
+	dqtLen := int(stream[4])<<8 | int(stream[5])
+	tables := append([]byte{0xff, 0xd8}, stream[2:4+dqtLen]...)
+	tables = append(tables, 0xff, 0xd9)
+	tile := append([]byte{0xff, 0xd8}, stream[4+dqtLen:]...)
+
+	ycbcr := grayIFD(256, 256, 256)
+	ycbcr.SamplesPerPixel = 3
+	ycbcr.BitsPerSample = []uint16{8, 8, 8}
+	ycbcr.SampleFormat = []uint16{1, 1, 1}
+	ycbcr.PhotometricInterpretation = photometricInterpretationYCbCr
+	ycbcr.Compression = compressionJPEG
+	ycbcr.JPEGTables = tables
+	withTiles(ycbcr, tile)
+	src := encodeTIFF(t, ycbcr)
+
+	cfg := DefaultConfig()
+	cfg.Transcode(CompressionJPEG, CompressionDeflate)
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	if ifds[0].Compression != compressionDeflate || ifds[0].PhotometricInterpretation != photometricInterpretationRGB ||
+		len(ifds[0].JPEGTables) != 0 {
+		t.Fatalf("unexpected tags: compression %d, photometric %d, %d bytes of jpeg tables",
+			ifds[0].Compression, ifds[0].PhotometricInterpretation, len(ifds[0].JPEGTables))
+	}
+	pix := decodedTiles(t, ifds[0])[0]
+	for i := 0; i < 256*256; i++ {
+		x, y := i%256, i/256
+		for b, v := range []int{x, y, 128} {
+			if d := int(pix[i*3+b]) - v; d < -8 || d > 8 {
+				t.Fatalf("pixel (%d,%d) band %d is %d, expected ~%d", x, y, b, pix[i*3+b], v)
+			}
+		}
+	}
+}
+
+func TestTranscodeUnsupported(t *testing.T) {
+	src, err := os.ReadFile("testdata/gray.tif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Transcode(CompressionLZW, CompressionJPEG)
+	if err := cfg.Rewrite(&bytes.Buffer{}, bytes.NewReader(src)); err == nil {
+		t.Error("expected an error for a lossy target")
+	}
+}
+
+func TestInlineJPEGTables(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 256, 256))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	enc := bytes.Buffer{}
+	if err := jpeg.Encode(&enc, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	//move the quantization table to JPEGTables, as libtiff does
+	stream := enc.Bytes()
+	dqtLen := int(stream[4])<<8 | int(stream[5])
+	tables := append([]byte{0xff, 0xd8}, stream[2:4+dqtLen]...)
+	tables = append(tables, 0xff, 0xd9)
+	tile := append([]byte{0xff, 0xd8}, stream[4+dqtLen:]...)
+
+	gray := grayIFD(256, 256, 256)
+	gray.Compression = compressionJPEG
+	gray.JPEGTables = tables
+	src := encodeTIFF(t, withTiles(gray, tile))
+
+	cfg := DefaultConfig()
+	cfg.InlineJPEGTables = true
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	out := parseIFDs(t, buf.Bytes())[0]
+	if len(out.JPEGTables) != 0 {
+		t.Error("JPEGTables tag not removed")
+	}
+	if int(out.TileByteCounts[0]) != len(tile)+len(tables)-4 {
+		t.Errorf("tile of %d bytes, expected %d", out.TileByteCounts[0], len(tile)+len(tables)-4)
+	}
+	dec, err := jpeg.Decode(bytes.NewReader(rawTile(t, out, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pix, ok := dec.(*image.Gray)
+	if !ok || pix.Bounds() != img.Bounds() {
+		t.Fatalf("decoded %T of bounds %v", dec, dec.Bounds())
+	}
+	for i := range img.Pix {
+		if d := int(pix.Pix[i]) - int(img.Pix[i]); d < -8 || d > 8 {
+			t.Fatalf("pixel %d is %d, expected ~%d", i, pix.Pix[i], img.Pix[i])
+		}
+	}
+}
+
+func TestOverviewScaler(t *testing.T) {
+	tile16 := func(v uint16) []byte {
+		tile := make([]byte, 256*256*2)
+		for i := 0; i < len(tile); i += 2 {
+			binary.LittleEndian.PutUint16(tile[i:], v+uint16(i/2%256))
+		}
+		return tile
+	}
+	main := withTiles(grayIFD(512, 512, 256), tile16(1000), tile16(2000), tile16(3000), tile16(4000))
+	ovr := withTiles(grayIFD(256, 256, 256), tile16(0x1200))
+	for _, ifd := range []*ifd{main, ovr} {
+		ifd.BitsPerSample = []uint16{16}
+	}
+	withOverviews(main, ovr)
+	cfg := DefaultConfig()
+	cfg.OverviewScaler = func(band int, v uint16) uint8 {
+		return uint8(v >> 8)
+	}
+	buf := bytes.Buffer{}
+	if err := cfg.Rewrite(&buf, bytes.NewReader(encodeTIFF(t, main))); err != nil {
+		t.Fatal(err)
+	}
+	ifds := parseIFDs(t, buf.Bytes())
+	if ifds[0].BitsPerSample[0] != 16 || ifds[1].BitsPerSample[0] != 8 {
+		t.Fatalf("BitsPerSample %v and %v", ifds[0].BitsPerSample, ifds[1].BitsPerSample)
+	}
+	if int(ifds[0].TileByteCounts[0]) != 256*256*2 {
+		t.Errorf("full resolution tile of %d bytes", ifds[0].TileByteCounts[0])
+	}
+	pix := decodedTiles(t, ifds[1])[0]
+	for i, v := range pix {
+		if expected := uint8((0x1200 + i%256) >> 8); v != expected {
+			t.Fatalf("pixel %d is %d, expected %d", i, v, expected)
+		}
+	}
+}
+
+func TestStrictJPEG(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 256, 256))
+	enc := bytes.Buffer{}
+	if err := jpeg.Encode(&enc, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	stream := enc.Bytes()
+	dqtLen := int(stream[4])<<8 | int(stream[5])
+	tables := append([]byte{0xff, 0xd8}, stream[2:4+dqtLen]...)
+	tables = append(tables, 0xff, 0xd9)
+	abbreviated := append([]byte{0xff, 0xd8}, stream[4+dqtLen:]...)
+
+	cfg := DefaultConfig()
+	cfg.StrictJPEG = true
+	for _, tc := range []struct {
+		name   string
+		tables []byte
+		tile   []byte
+		valid  bool
+	}{
+		{"standalone tile", nil, stream, true},
+		{"abbreviated tile with tables", tables, abbreviated, true},
+		{"abbreviated tile without tables", nil, abbreviated, false},
+	} {
+		gray := grayIFD(256, 256, 256)
+		gray.Compression = compressionJPEG
+		gray.JPEGTables = tc.tables
+		src := encodeTIFF(t, withTiles(gray, tc.tile))
+		if err := Rewrite(io.Discard, bytes.NewReader(src)); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		err := cfg.Rewrite(io.Discard, bytes.NewReader(src))
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: strict error %v", tc.name, err)
+		}
+	}
+}